@@ -104,9 +104,9 @@ func main() {
 	// infoData, _ := json.Marshal(&info)
 	// st.SetContractInfo(contract.Address().Bytes(), infoData)
 
-	eng := vm.NewEngine(contract, contract.Gas, st, log.With("mod", "wasm"))
+	eng := vm.NewEngine(contract, contract.Gas, st, log.With("mod", "wasm"), nil, nil)
 	eng.SetTrace(false)
-	wasm.Inject(&ctx, st)
+	wasm.Inject(eng, &ctx)
 
 	start := time.Now()
 
@@ -136,10 +136,9 @@ func main() {
 		return
 	}
 
-	vmem := app.VM.VMemory()
-	rBytes, err := vmem.GetString(ret)
+	rBytes, err := eng.Output(app, ret)
 	if err != nil {
-		fmt.Printf("ERR init vm/MemManager.GetBytes failed, err: %v", err)
+		fmt.Printf("ERR init vm/Engine.Output failed, err: %v", err)
 		return
 	}
 
@@ -185,10 +184,9 @@ func main() {
 		return
 	}
 
-	vmem = app.VM.VMemory()
-	rBytes, err = vmem.GetString(ret)
+	rBytes, err = eng.Output(app, ret)
 	if err != nil {
-		fmt.Printf("ERR call vm/MemManager.GetBytes failed, err: %v", err)
+		fmt.Printf("ERR call vm/Engine.Output failed, err: %v", err)
 		return
 	}
 
@@ -1,6 +1,7 @@
 package wasm
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
 
@@ -11,58 +12,102 @@ import (
 )
 
 var (
-	ctx *Context
-	db  types.StateDB
+	// ChainModule holds the host functions reading and writing chain state.
+	ChainModule = vm.NewHostModule("chain")
+
+	chainEnvTable *vm.EnvTable
 )
 
 func init() {
-	env := vm.NewEnvTable()
-
-	env.RegisterFunc("TC_StorageSet", &TCStorageSet{}) //removed
-	env.RegisterFunc("TC_StorageGet", &TCStorageGet{}) //removed
-
-	env.RegisterFunc("TC_StorageSetString", &TCStorageSet{})
-	env.RegisterFunc("TC_StorageSetBytes", &TCStorageSetBytes{})
-	env.RegisterFunc("TC_StoragePureSetString", &TCStoragePureSetString{})
-	env.RegisterFunc("TC_StoragePureSetBytes", &TCStoragePureSetBytes{})
-	env.RegisterFunc("TC_StorageGetString", &TCStorageGet{})
-	env.RegisterFunc("TC_StorageGetBytes", &TCStorageGet{})
-	env.RegisterFunc("TC_StoragePureGetString", &TCStoragePureGet{})
-	env.RegisterFunc("TC_StoragePureGetBytes", &TCStoragePureGet{})
-
-	env.RegisterFunc("TC_StorageDel", &TCStorageDel{})
-	env.RegisterFunc("TC_ContractStorageGet", &TCContractStorageGet{})
-	env.RegisterFunc("TC_ContractStoragePureGet", &TCContractStoragePureGet{})
-	env.RegisterFunc("TC_Notify", &TCNotify{})
-	env.RegisterFunc("TC_BlockHash", &TCBlockHash{})
-	env.RegisterFunc("TC_GetCoinbase", &TCGetCoinbase{})
-	env.RegisterFunc("TC_GetGasLimit", &TCGetGasLimit{})
-	env.RegisterFunc("TC_GetNumber", &TCGetNumber{})
-	env.RegisterFunc("TC_Now", &TCNow{})
-	env.RegisterFunc("TC_GetTxGasPrice", &TCGetTxGasPrice{})
-	env.RegisterFunc("TC_GetTxOrigin", &TCGetTxOrigin{})
-	env.RegisterFunc("TC_Log0", &TCLog0{})
-	env.RegisterFunc("TC_Log1", &TCLog1{})
-	env.RegisterFunc("TC_Log2", &TCLog2{})
-	env.RegisterFunc("TC_Log3", &TCLog3{})
-	env.RegisterFunc("TC_Log4", &TCLog4{})
-	env.RegisterFunc("TC_SelfDestruct", &TCSelfDestruct{})
-	env.RegisterFunc("TC_GetBalance", &TCGetBalance{})
-	env.RegisterFunc("TC_CheckSign", new(TCCheckSign))
-	env.RegisterFunc("TC_Ecrecover", new(TCEcrecover))
-
-	env.RegisterFunc("TC_Issue", &TCIssue{})
-	env.RegisterFunc("TC_Transfer", &TCTransfer{})
-	env.RegisterFunc("TC_TransferToken", &TCTransferToken{})
-	env.RegisterFunc("TC_TokenBalance", &TCTokenBalance{})
-	env.RegisterFunc("TC_TokenAddress", &TCTokenAddress{})
-	env.RegisterFunc("TC_GetMsgValue", &TCGetMsgValue{})
-	env.RegisterFunc("TC_GetMsgTokenValue", &TCGetMsgTokenValue{})
-}
-
-func Inject(context *Context, stateDB types.StateDB) {
-	ctx = context
-	db = stateDB
+	env := ChainModule
+
+	env.Register("TC_StorageSet", "(ii)", &TCStorageSet{}) //removed
+	env.Register("TC_StorageGet", "(i)i", &TCStorageGet{}) //removed
+
+	env.Register("TC_StorageSetString", "(ii)", &TCStorageSet{})
+	env.Register("TC_StorageSetBytes", "(iii)", &TCStorageSetBytes{})
+	env.Register("TC_StoragePureSetString", "(iii)", &TCStoragePureSetString{})
+	env.Register("TC_StoragePureSetBytes", "(iiii)", &TCStoragePureSetBytes{})
+	env.Register("TC_StorageGetString", "(i)i", &TCStorageGet{})
+	env.Register("TC_StorageGetBytes", "(i)i", &TCStorageGet{})
+	env.Register("TC_StoragePureGetString", "(ii)i", &TCStoragePureGet{})
+	env.Register("TC_StoragePureGetBytes", "(ii)i", &TCStoragePureGet{})
+
+	env.Register("TC_StorageDel", "(i)", &TCStorageDel{})
+	env.Register("TC_ContractStorageGet", "(ii)i", &TCContractStorageGet{})
+	env.Register("TC_ContractStoragePureGet", "(iii)i", &TCContractStoragePureGet{})
+	env.Register("TC_Notify", "(ii)", &TCNotify{})
+	env.Register("TC_BlockHash", "(I)i", &TCBlockHash{})
+	env.Register("TC_GetCoinbase", "()i", &TCGetCoinbase{})
+	env.Register("TC_GetGasLimit", "()I", &TCGetGasLimit{})
+	env.Register("TC_GetNumber", "()I", &TCGetNumber{})
+	env.Register("TC_Now", "()I", &TCNow{})
+	env.Register("TC_GetTxGasPrice", "()I", &TCGetTxGasPrice{})
+	env.Register("TC_GetTxOrigin", "()i", &TCGetTxOrigin{})
+	env.Register("TC_Log0", "(i)i", &TCLog0{})
+	env.Register("TC_Log1", "(ii)i", &TCLog1{})
+	env.Register("TC_Log2", "(iii)i", &TCLog2{})
+	env.Register("TC_Log3", "(iiii)i", &TCLog3{})
+	env.Register("TC_Log4", "(iiiii)i", &TCLog4{})
+	env.Register("TC_SelfDestruct", "(i)i", &TCSelfDestruct{})
+	env.Register("TC_GetBalance", "(i)i", &TCGetBalance{})
+	env.Register("TC_CheckSign", "(iii)i", new(TCCheckSign))
+	env.Register("TC_Ecrecover", "(iiii)i", new(TCEcrecover))
+
+	env.Register("TC_Issue", "(i)", &TCIssue{})
+	env.Register("TC_Transfer", "(ii)", &TCTransfer{})
+	env.Register("TC_TransferToken", "(iii)", &TCTransferToken{})
+	env.Register("TC_TokenBalance", "(ii)i", &TCTokenBalance{})
+	env.Register("TC_TokenAddress", "()i", &TCTokenAddress{})
+	env.Register("TC_GetMsgValue", "()i", &TCGetMsgValue{})
+	env.Register("TC_GetMsgTokenValue", "()i", &TCGetMsgTokenValue{})
+	env.Register("TC_CallContractWithValue", "(iiiii)i", &TCCallContractWithValue{})
+
+	// tc2 api, see api2.go
+	env.Register("tc2_storage_set", "(iiii)", &TC2StorageSet{})
+	env.Register("tc2_storage_get", "(iiii)i", &TC2StorageGet{})
+	env.Register("tc2_storage_del", "(ii)", &TC2StorageDel{})
+	env.Register("tc2_balance", "(ii)", &TC2Balance{})
+	env.Register("tc2_transfer", "(ii)", &TC2Transfer{})
+	env.Register("tc2_msg_value", "(i)", &TC2MsgValue{})
+	env.Register("tc2_notify", "(iiii)", &TC2Notify{})
+	env.Register("tc2_log", "(iiii)", &TC2Log{})
+
+	chainEnvTable = vm.NewEnvTable(append(vm.BaseModules(), ChainModule)...)
+}
+
+// Inject attaches the chain context of the transaction run by eng, host
+// functions read it, and the StateDB, from the engine they are called with.
+// Engines still on vm.DefaultEnvTable are switched to ChainEnvTable.
+func Inject(eng *vm.Engine, context *Context) {
+	eng.Ctx = context
+	if eng.EnvTable() == vm.DefaultEnvTable() {
+		eng.SetEnvTable(chainEnvTable)
+	}
+}
+
+// ChainEnvTable returns the EnvTable composed of vm.BaseModules and
+// ChainModule, bound by Inject to engines using vm.DefaultEnvTable.
+func ChainEnvTable() *vm.EnvTable {
+	return chainEnvTable
+}
+
+// ErrNoContext is returned by the host functions reading the chain context
+// of an engine which was not passed to Inject.
+var ErrNoContext = errors.New("wasm: engine without chain context")
+
+// chainContext returns the chain context attached to eng by Inject.
+func chainContext(eng *vm.Engine) (*Context, error) {
+	ctx, ok := eng.Ctx.(*Context)
+	if !ok {
+		return nil, ErrNoContext
+	}
+	return ctx, nil
+}
+
+// stateDB returns the StateDB eng runs on.
+func stateDB(eng *vm.Engine) types.StateDB {
+	return eng.State.(types.StateDB)
 }
 
 type TCNotify struct{}
@@ -78,6 +123,14 @@ func (t *TCNotify) Gas(index int64, ops interface{}, args []uint64) (uint64, err
 
 //c: void TC_Notify(char* eventID, char* data)
 func tcNotify(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return 0, err
+	}
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
 	runningFrame, _ := eng.RunningAppFrame()
 	vmem := runningFrame.VM.VMemory()
 	eventID, err := vmem.GetString(args[0])
@@ -119,6 +172,10 @@ func (t *TCStorageSetBytes) Gas(index int64, ops interface{}, args []uint64) (ui
 
 //c: void TC_StorageSetBytes(const char* key, const uint8_t* val, uint32_t size);
 func tcStorageSetBytes(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
 	app, _ := eng.RunningAppFrame()
 	vmem := app.VM.VMemory()
 	key, err := vmem.GetString(args[0])
@@ -148,6 +205,10 @@ func (t *TCStoragePureSetString) Gas(index int64, ops interface{}, args []uint64
 
 //c:void TC_StoragePureSetString(const uint8_t* key, uint32_t size1, const char* val);
 func tcStoragePureSetString(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
 	app, _ := eng.RunningAppFrame()
 	vmem := app.VM.VMemory()
 	key, err := vmem.GetBytes(args[0], int(args[1]))
@@ -177,6 +238,10 @@ func (t *TCStoragePureSetBytes) Gas(index int64, ops interface{}, args []uint64)
 
 //c: void TC_StoragePureSetBytes(const uint8_t* key, uint32_t size1, const uint8_t* val, uint32_t size2);
 func tcStoragePureSetBytes(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
 	app, _ := eng.RunningAppFrame()
 	vmem := app.VM.VMemory()
 	key, err := vmem.GetBytes(args[0], int(args[1]))
@@ -207,6 +272,7 @@ func (t *TCStoragePureGet) Gas(index int64, ops interface{}, args []uint64) (uin
 //char* TC_StoragePureGetString(const uint8_t* key, uint32_t size);
 //uint8_t* TC_StoragePureGetBytes(const uint8_t* key, uint32_t size);
 func tcStoragePureGet(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
 	app, _ := eng.RunningAppFrame()
 	vmem := app.VM.VMemory()
 	key, err := vmem.GetBytes(args[0], int(args[1]))
@@ -239,6 +305,7 @@ func (t *TCStorageGet) Gas(index int64, ops interface{}, args []uint64) (uint64,
 //char* TC_StorageGetString(const char* key);
 //uint8_t* TC_StorageGetBytes(const char* key);
 func tcStorageGet(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
 	app, _ := eng.RunningAppFrame()
 	vmem := app.VM.VMemory()
 	key, err := vmem.GetString(args[0])
@@ -269,6 +336,7 @@ func (t *TCContractStorageGet) Gas(index int64, ops interface{}, args []uint64)
 
 // c: char * TC_ContractStorageGet(address contract, char *key)
 func tcContractStorageGet(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
 	app, _ := eng.RunningAppFrame()
 	vmem := app.VM.VMemory()
 	contract, err := vmem.GetString(args[0])
@@ -305,6 +373,7 @@ func (t *TCContractStoragePureGet) Gas(index int64, ops interface{}, args []uint
 
 // c: char * TC_ContractStoragePureGet(address contract, uint8_t* key, uint32_t size)
 func tcContractStoragePureGet(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
 	app, _ := eng.RunningAppFrame()
 	vmem := app.VM.VMemory()
 	contract, err := vmem.GetString(args[0])
@@ -341,6 +410,10 @@ func (t *TCStorageSet) Gas(index int64, ops interface{}, args []uint64) (uint64,
 
 //c: void TC_StorageSetString(const char* key, const char* val);
 func tcStorageSet(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
 	app, _ := eng.RunningAppFrame()
 	vmem := app.VM.VMemory()
 	key, err := vmem.GetString(args[0])
@@ -370,6 +443,10 @@ func (t *TCStorageDel) Gas(index int64, ops interface{}, args []uint64) (uint64,
 
 // c: void TC_StorageDel(char *key)
 func tcStorageDel(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
 	app, _ := eng.RunningAppFrame()
 	vmem := app.VM.VMemory()
 	key, err := vmem.GetString(args[0])
@@ -396,6 +473,10 @@ func (t *TCBlockHash) Gas(index int64, ops interface{}, args []uint64) (uint64,
 
 //char *TC_blockhash(long long blockNumber)
 func tcBlockHash(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return 0, err
+	}
 	if len(args) != 1 {
 		return 0, vm.ErrInvalidApiArgs
 	}
@@ -426,6 +507,10 @@ func (t *TCGetCoinbase) Gas(index int64, ops interface{}, args []uint64) (uint64
 
 // char *TC_get_coinbase()
 func tcGetCoinbase(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return 0, err
+	}
 	if len(args) != 0 {
 		return 0, vm.ErrInvalidApiArgs
 	}
@@ -455,6 +540,10 @@ func (t *TCGetGasLimit) Gas(index int64, ops interface{}, args []uint64) (uint64
 
 // long long TC_get_gaslimit()
 func tcGetGasLimit(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return 0, err
+	}
 	if len(args) != 0 {
 		return 0, vm.ErrInvalidApiArgs
 	}
@@ -476,6 +565,10 @@ func (t *TCGetNumber) Gas(index int64, ops interface{}, args []uint64) (uint64,
 
 // long long TC_get_number()
 func tcGetNumber(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return 0, err
+	}
 	if len(args) != 0 {
 		return 0, vm.ErrInvalidApiArgs
 	}
@@ -495,6 +588,10 @@ func (t *TCGetTimestamp) Gas(index int64, ops interface{}, args []uint64) (uint6
 
 // long long TC_get_timestamp()
 func tcGetTimestamp(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return 0, err
+	}
 	if len(args) != 0 {
 		return 0, vm.ErrInvalidApiArgs
 	}
@@ -514,6 +611,10 @@ func (t *TCNow) Gas(index int64, ops interface{}, args []uint64) (uint64, error)
 
 // long long TC_now()
 func tcNow(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return 0, err
+	}
 	if len(args) != 0 {
 		return 0, vm.ErrInvalidApiArgs
 	}
@@ -533,6 +634,10 @@ func (t *TCGetTxGasPrice) Gas(index int64, ops interface{}, args []uint64) (uint
 
 // long long TC_get_tx_gasprice()
 func tcGetTxGasPrice(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return 0, err
+	}
 	if len(args) != 0 {
 		return 0, vm.ErrInvalidApiArgs
 	}
@@ -552,6 +657,10 @@ func (t *TCGetTxOrigin) Gas(index int64, ops interface{}, args []uint64) (uint64
 
 // char *TC_get_tx_origin()
 func tcGetTxOrigin(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return 0, err
+	}
 	if len(args) != 0 {
 		return 0, vm.ErrInvalidApiArgs
 	}
@@ -579,6 +688,7 @@ func (t *TCGetBalance) Gas(index int64, ops interface{}, args []uint64) (uint64,
 
 //char* TC_GetBalance(char *address)
 func tcGetBalance(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
 	runningFrame, _ := eng.RunningAppFrame()
 	vmem := runningFrame.VM.VMemory()
 	addrTmp, err := vmem.GetString(args[0])
@@ -604,6 +714,10 @@ func (t *TCTransfer) Gas(index int64, ops interface{}, args []uint64) (uint64, e
 
 //void TC_Transfer(char *address, char* amount)
 func tcTransfer(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
 	runningFrame, _ := eng.RunningAppFrame()
 	vmem := runningFrame.VM.VMemory()
 	from := eng.Contract.Self.Address()
@@ -647,6 +761,10 @@ func (t *TCTransferToken) Gas(index int64, ops interface{}, args []uint64) (uint
 
 //void TC_TransferToken(char *address, char* tokenAddress, char* amount)
 func tcTransferToken(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
 	runningFrame, _ := eng.RunningAppFrame()
 	vmem := runningFrame.VM.VMemory()
 	from := eng.Contract.Self.Address()
@@ -708,6 +826,10 @@ func (t *TCSelfDestruct) Gas(index int64, ops interface{}, args []uint64) (uint6
 
 //char *TC_SelfDestruct(char* recipient)
 func tcSelfDestruct(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
 	runningFrame, _ := eng.RunningAppFrame()
 	vmem := runningFrame.VM.VMemory()
 	addr := eng.Contract.Self.Address()
@@ -724,9 +846,6 @@ func tcSelfDestruct(eng *vm.Engine, index int64, args []uint64) (uint64, error)
 
 	//suicideToken(eng, addr, to)
 	db.Suicide(addr)
-	//delete cache
-	eng.RemoveCache(addr.String())
-	// eng.AppCache.Delete(addr.String())
 
 	return 0, nil
 }
@@ -745,6 +864,14 @@ func (t *TCLog0) Gas(index int64, ops interface{}, args []uint64) (uint64, error
 
 //void TC_Log0(char* data)
 func tcLog0(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return 0, err
+	}
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
 	runningFrame, _ := eng.RunningAppFrame()
 	vmem := runningFrame.VM.VMemory()
 	dataTmp, err := vmem.GetString(args[0])
@@ -779,6 +906,14 @@ func (t *TCLog1) Gas(index int64, ops interface{}, args []uint64) (uint64, error
 
 //void TC_Log1(char* data, char* topic)
 func tcLog1(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return 0, err
+	}
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
 	runningFrame, _ := eng.RunningAppFrame()
 	vmem := runningFrame.VM.VMemory()
 	dataTmp, err := vmem.GetString(args[0])
@@ -821,6 +956,14 @@ func (t *TCLog2) Gas(index int64, ops interface{}, args []uint64) (uint64, error
 
 //void TC_Log2(char* data, char* topic1, char* topic2)
 func tcLog2(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return 0, err
+	}
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
 	runningFrame, _ := eng.RunningAppFrame()
 	vmem := runningFrame.VM.VMemory()
 	dataTmp, err := vmem.GetString(args[0])
@@ -863,6 +1006,14 @@ func (t *TCLog3) Gas(index int64, ops interface{}, args []uint64) (uint64, error
 
 //void TC_Log3(char* data, char* topic1, char* topic2, char* topic3)
 func tcLog3(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return 0, err
+	}
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
 	runningFrame, _ := eng.RunningAppFrame()
 	vmem := runningFrame.VM.VMemory()
 	dataTmp, err := vmem.GetString(args[0])
@@ -905,6 +1056,14 @@ func (t *TCLog4) Gas(index int64, ops interface{}, args []uint64) (uint64, error
 
 //void TC_Log4(char* data, char* topic1, char* topic2, char* topic3, char* topic4)
 func tcLog4(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return 0, err
+	}
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
 	runningFrame, _ := eng.RunningAppFrame()
 	vmem := runningFrame.VM.VMemory()
 	dataTmp, err := vmem.GetString(args[0])
@@ -946,6 +1105,10 @@ func (t *TCIssue) Gas(index int64, ops interface{}, args []uint64) (uint64, erro
 
 //void TC_Issue(char* amount);
 func tcIssue(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
 	runningFrame, _ := eng.RunningAppFrame()
 	vmem := runningFrame.VM.VMemory()
 	amountTmp, err := vmem.GetString(args[0])
@@ -978,6 +1141,7 @@ func (t *TCTokenBalance) Gas(index int64, ops interface{}, args []uint64) (uint6
 
 //char* TC_TokenBalance(char* addr, char* token);
 func tcTokenBalance(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
 	runningFrame, _ := eng.RunningAppFrame()
 	vmem := runningFrame.VM.VMemory()
 	addrTmp, err := vmem.GetString(args[0])
@@ -1015,10 +1179,14 @@ func (t *TCTokenAddress) Gas(index int64, ops interface{}, args []uint64) (uint6
 func tcTokenAddress(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
 	runningFrame, _ := eng.RunningAppFrame()
 	vmem := runningFrame.VM.VMemory()
-	if ctx.Token == types.EmptyAddress {
+	token, err := msgToken(eng)
+	if err != nil {
+		return 0, err
+	}
+	if token == types.EmptyAddress {
 		return vmem.SetBytes([]byte(types.Address{}.String()))
 	}
-	return vmem.SetBytes([]byte(ctx.Token.String()))
+	return vmem.SetBytes([]byte(token.String()))
 }
 
 type TCGetMsgValue struct{}
@@ -1040,11 +1208,12 @@ func tcGetMsgValue(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
 	app, _ := eng.RunningAppFrame()
 	vmem := app.VM.VMemory()
 	vStr := eng.Contract.Value().String()
-	var (
-		dataPtr uint64
-		err     error
-	)
-	if ctx.Token == types.EmptyAddress {
+	token, err := msgToken(eng)
+	if err != nil {
+		return 0, err
+	}
+	var dataPtr uint64
+	if token == types.EmptyAddress {
 		dataPtr, err = vmem.SetBytes([]byte(vStr))
 	} else {
 		dataPtr, err = vmem.SetBytes([]byte(big.NewInt(0).String()))
@@ -1056,8 +1225,12 @@ func tcGetMsgValue(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
 }
 
 func gasGetMsgValue(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	token, err := msgToken(eng)
+	if err != nil {
+		return 0, err
+	}
 	valLen := 1
-	if ctx.Token == types.EmptyAddress {
+	if token == types.EmptyAddress {
 		valLen = len(eng.Contract.Value().String())
 	}
 	gas := vm.GasExtStep
@@ -1090,11 +1263,12 @@ func tcGetMsgTokenValue(eng *vm.Engine, index int64, args []uint64) (uint64, err
 	app, _ := eng.RunningAppFrame()
 	vmem := app.VM.VMemory()
 	vStr := eng.Contract.Value().String()
-	var (
-		dataPtr uint64
-		err     error
-	)
-	if ctx.Token == types.EmptyAddress {
+	token, err := msgToken(eng)
+	if err != nil {
+		return 0, err
+	}
+	var dataPtr uint64
+	if token == types.EmptyAddress {
 		dataPtr, err = vmem.SetBytes([]byte(big.NewInt(0).String()))
 	} else {
 		dataPtr, err = vmem.SetBytes([]byte(vStr))
@@ -1106,8 +1280,12 @@ func tcGetMsgTokenValue(eng *vm.Engine, index int64, args []uint64) (uint64, err
 }
 
 func gasGetMsgTokenValue(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	token, err := msgToken(eng)
+	if err != nil {
+		return 0, err
+	}
 	valLen := len(eng.Contract.Value().String())
-	if ctx.Token == types.EmptyAddress {
+	if token == types.EmptyAddress {
 		valLen = 1
 	}
 	gas := vm.GasExtStep
@@ -1121,6 +1299,95 @@ func gasGetMsgTokenValue(eng *vm.Engine, index int64, args []uint64) (uint64, er
 	return gas, nil
 }
 
+// msgToken returns the token in which the value of the running contract is
+// paid: the one forwarded by TC_CallContractWithValue, or the token of the
+// transaction.
+func msgToken(eng *vm.Engine) (types.Address, error) {
+	if token, ok := eng.Contract.Token(); ok {
+		return token, nil
+	}
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return types.Address{}, err
+	}
+	return ctx.Token, nil
+}
+
+type TCCallContractWithValue struct{}
+
+func (t *TCCallContractWithValue) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return tcCallContractWithValue(eng, index, args)
+}
+func (t *TCCallContractWithValue) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return vm.GasCallContractWithValue(eng, index, args)
+}
+
+//c: char *TC_CallContractWithValue(char *app, char *action, char *args, char *value, char *token)
+func tcCallContractWithValue(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return 0, err
+	}
+	if ctx.CanTransfer == nil || ctx.Transfer == nil {
+		return 0, ErrNoContext
+	}
+	db := stateDB(eng)
+	if len(args) != 5 {
+		return 0, vm.ErrInvalidApiArgs
+	}
+	runningFrame, _ := eng.RunningAppFrame()
+	if runningFrame == nil {
+		return 0, vm.ErrEmptyFrame
+	}
+	vmem := runningFrame.VM.VMemory()
+	appName, err := vmem.GetString(args[0])
+	if err != nil || !types.IsHexAddress(string(appName)) {
+		return 0, vm.ErrInvalidApiArgs
+	}
+	action, err := vmem.GetString(args[1])
+	if err != nil {
+		return 0, vm.ErrInvalidApiArgs
+	}
+	params, err := vmem.GetString(args[2])
+	if err != nil {
+		return 0, vm.ErrInvalidApiArgs
+	}
+	valTmp, err := vmem.GetString(args[3])
+	if err != nil {
+		return 0, vm.ErrInvalidApiArgs
+	}
+	val, ok := big.NewInt(0).SetString(string(valTmp), 0)
+	if !ok || val.Sign() < 0 {
+		return 0, vm.ErrInvalidApiArgs
+	}
+	tokenTmp, err := vmem.GetString(args[4])
+	if err != nil || !types.IsHexAddress(string(tokenTmp)) {
+		return 0, vm.ErrInvalidApiArgs
+	}
+	token := types.HexToAddress(string(tokenTmp))
+
+	from := eng.Contract.Self.Address()
+	to := types.HexToAddress(string(appName))
+	if val.Sign() != 0 && eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
+	if !ctx.CanTransfer(db, from, token, val) {
+		return 0, vm.ErrBalanceNotEnough
+	}
+
+	eng.Logger().Debug("tcCallContractWithValue", "from", from.String(), "to", to.String(), "token", token.String(), "val", val)
+	snapshot := db.Snapshot()
+	ctx.Transfer(db, from, to, token, val)
+	ret, err := eng.CallContract(string(appName), action, params, val, token)
+	if err != nil {
+		db.RevertToSnapshot(snapshot)
+		return 0, err
+	}
+	return ret, nil
+}
+
 type TCCheckSign struct{}
 
 func (t *TCCheckSign) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
@@ -0,0 +1,258 @@
+package wasm
+
+import (
+	"math/big"
+
+	"github.com/xunleichain/tc-wasm/mock/types"
+	"github.com/xunleichain/tc-wasm/vm"
+)
+
+// maxLogTopics is the number of topics tc2_log accepts at most.
+const maxLogTopics = 4
+
+type TC2StorageSet struct{}
+
+func (t *TC2StorageSet) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return tc2StorageSet(eng, index, args)
+}
+func (t *TC2StorageSet) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return vm.GasStoragePureSetBytes(eng, index, args)
+}
+
+// void tc2_storage_set(const uint8_t *key, uint32_t key_len, const uint8_t *val, uint32_t val_len)
+func tc2StorageSet(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
+	key, err := eng.ReadMemory(args[0], args[1])
+	if err != nil {
+		return 0, err
+	}
+	val, err := eng.ReadMemory(args[2], args[3])
+	if err != nil {
+		return 0, err
+	}
+	eng.Logger().Debug("tc2_storage_set", "key", string(key), "size", len(key), "val", val, "size", len(val))
+
+	db.SetState(eng.Contract.Address(), types.Keccak256Hash(key), val)
+	return 0, nil
+}
+
+type TC2StorageGet struct{}
+
+func (t *TC2StorageGet) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return tc2StorageGet(eng, index, args)
+}
+func (t *TC2StorageGet) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return vm.GasStoragePureGet(eng, index, args)
+}
+
+// uint32_t tc2_storage_get(const uint8_t *key, uint32_t key_len, uint8_t *out, uint32_t cap)
+func tc2StorageGet(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
+	key, err := eng.ReadMemory(args[0], args[1])
+	if err != nil {
+		return 0, err
+	}
+	val := db.GetState(eng.Contract.Address(), types.Keccak256Hash(key))
+	eng.Logger().Debug("tc2_storage_get", "key", string(key), "val", val, "size", len(val))
+
+	return eng.WriteBuffer(args[2], args[3], val)
+}
+
+type TC2StorageDel struct{}
+
+func (t *TC2StorageDel) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return tc2StorageDel(eng, index, args)
+}
+func (t *TC2StorageDel) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return vm.GasStorageDel(eng, index, args)
+}
+
+// void tc2_storage_del(const uint8_t *key, uint32_t key_len)
+func tc2StorageDel(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
+	key, err := eng.ReadMemory(args[0], args[1])
+	if err != nil {
+		return 0, err
+	}
+	eng.Logger().Debug("tc2_storage_del", "key", string(key))
+
+	var val []byte
+	db.SetState(eng.Contract.Address(), types.Keccak256Hash(key), val)
+	return 0, nil
+}
+
+type TC2Balance struct{}
+
+func (t *TC2Balance) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return tc2Balance(eng, index, args)
+}
+func (t *TC2Balance) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return vm.GasGetBalance(eng, index, args)
+}
+
+// void tc2_balance(const uint8_t addr[20], uint8_t out[32])
+func tc2Balance(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
+	addr, err := eng.ReadAddress(args[0])
+	if err != nil {
+		return 0, err
+	}
+	balance := db.GetBalance(addr)
+	eng.Logger().Debug("tc2_balance", "addr", addr.String(), "balance", balance.String())
+	return 0, eng.WriteAmount(args[1], balance)
+}
+
+type TC2Transfer struct{}
+
+func (t *TC2Transfer) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return tc2Transfer(eng, index, args)
+}
+func (t *TC2Transfer) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return vm.GasTransfer(eng, index, args)
+}
+
+// void tc2_transfer(const uint8_t addr[20], const uint8_t amount[32])
+func tc2Transfer(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	db := stateDB(eng)
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
+	from := eng.Contract.Self.Address()
+	to, err := eng.ReadAddress(args[0])
+	if err != nil {
+		return 0, err
+	}
+	val, err := eng.ReadAmount(args[1])
+	if err != nil {
+		return 0, err
+	}
+
+	eng.Logger().Debug("tc2_transfer", "from", from.String(), "to", to.String(), "val", val)
+	if val.Sign() == 0 {
+		return 0, nil
+	}
+	if db.GetBalance(from).Cmp(val) < 0 {
+		return 0, vm.ErrBalanceNotEnough
+	}
+	db.SubBalance(from, val)
+	db.AddBalance(to, val)
+
+	return 0, nil
+}
+
+type TC2MsgValue struct{}
+
+func (t *TC2MsgValue) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return tc2MsgValue(eng, index, args)
+}
+func (t *TC2MsgValue) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return gasGetMsgValue(eng, index, args)
+}
+
+// void tc2_msg_value(uint8_t out[32])
+func tc2MsgValue(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	token, err := msgToken(eng)
+	if err != nil {
+		return 0, err
+	}
+	val := big.NewInt(0)
+	if token == types.EmptyAddress {
+		val = eng.Contract.Value()
+	}
+	return 0, eng.WriteAmount(args[0], val)
+}
+
+type TC2Notify struct{}
+
+func (t *TC2Notify) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return tc2Notify(eng, index, args)
+}
+func (t *TC2Notify) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return vm.GasTC2Notify(eng, index, args)
+}
+
+// void tc2_notify(const uint8_t *event, uint32_t event_len, const uint8_t *data, uint32_t data_len)
+func tc2Notify(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
+	event, err := eng.ReadMemory(args[0], args[1])
+	if err != nil {
+		return 0, err
+	}
+	data, err := eng.ReadMemory(args[2], args[3])
+	if err != nil {
+		return 0, err
+	}
+	return 0, addLog(eng, []types.Hash{types.Keccak256Hash(event)}, data)
+}
+
+type TC2Log struct{}
+
+func (t *TC2Log) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return tc2Log(eng, index, args)
+}
+func (t *TC2Log) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*vm.Engine)
+	return vm.GasTC2Log(eng, index, args)
+}
+
+// void tc2_log(const uint8_t (*topics)[32], uint32_t n, const uint8_t *data, uint32_t data_len)
+func tc2Log(eng *vm.Engine, index int64, args []uint64) (uint64, error) {
+	if eng.IsReadOnly() {
+		return 0, vm.ErrWriteProtection
+	}
+	if args[1] > maxLogTopics {
+		return 0, vm.ErrInvalidApiArgs
+	}
+	raw, err := eng.ReadMemory(args[0], args[1]*types.HashLength)
+	if err != nil {
+		return 0, err
+	}
+	topics := make([]types.Hash, 0, args[1])
+	for i := 0; i < len(raw); i += types.HashLength {
+		topics = append(topics, types.BytesToHash(raw[i:i+types.HashLength]))
+	}
+	data, err := eng.ReadMemory(args[2], args[3])
+	if err != nil {
+		return 0, err
+	}
+	return 0, addLog(eng, topics, data)
+}
+
+// addLog records a log of the running contract in the current block.
+func addLog(eng *vm.Engine, topics []types.Hash, data []byte) error {
+	ctx, err := chainContext(eng)
+	if err != nil {
+		return err
+	}
+	stateDB(eng).AddLog(&types.Log{
+		Address:     eng.Contract.Self.Address(),
+		Topics:      topics,
+		Data:        data,
+		BlockNumber: ctx.BlockNumber.Uint64(),
+		BlockTime:   ctx.Time.Uint64(),
+	})
+	return nil
+}
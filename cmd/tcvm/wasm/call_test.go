@@ -0,0 +1,317 @@
+package wasm
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/xunleichain/tc-wasm/mock/log"
+	"github.com/xunleichain/tc-wasm/mock/types"
+	"github.com/xunleichain/tc-wasm/mock/wasmtest"
+	"github.com/xunleichain/tc-wasm/vm"
+)
+
+// contractDataBase is where the data of contractCode is laid out, past the
+// fixed stack, and contractHeap its heap base.
+const (
+	contractDataBase = 16384
+	contractHeap     = contractDataBase + 1024
+)
+
+// testContext returns the chain context of the contracts called through
+// WASM.
+func testContext() Context {
+	return Context{
+		Time:        new(big.Int).SetUint64(ctxTime),
+		BlockNumber: big.NewInt(3456),
+		WasmGasRate: 1,
+		CanTransfer: CanTransfer,
+		Transfer:    Transfer,
+	}
+}
+
+// hostImport is a function imported from env by contractCode.
+type hostImport struct {
+	name            string
+	params, results []byte
+}
+
+// contractData is the data segment of contractCode.
+type contractData []byte
+
+// add appends s, NUL-terminated, and returns the instruction pushing its
+// address.
+func (d *contractData) add(s string) []byte {
+	addr := contractDataBase + len(*d)
+	*d = append(append(*d, s...), 0)
+	return wasmtest.I32Const(int32(addr))
+}
+
+// contractModule returns a contract importing funcs from env, with data,
+// whose entry, the function len(funcs), runs body.
+func contractModule(funcs []hostImport, data contractData, body ...byte) *wasmtest.Module {
+	i32 := wasmtest.I32
+	m := &wasmtest.Module{}
+	for i, f := range funcs {
+		m.Types = append(m.Types, wasmtest.Type{Params: f.params, Results: f.results})
+		m.Imports = append(m.Imports, wasmtest.Import{Module: "env", Field: f.name, Type: uint32(i)})
+	}
+	m.Types = append(m.Types, wasmtest.Type{Params: []byte{i32, i32}, Results: []byte{i32}})
+	m.Funcs = []wasmtest.Func{{Type: uint32(len(funcs)), Code: body}}
+	m.Memory = &wasmtest.Limits{Min: 1}
+	m.Globals = []wasmtest.Global{{Type: i32, Init: wasmtest.I32Const(contractHeap)}}
+	m.Exports = []wasmtest.Export{
+		{Name: vm.APPEntry, Kind: wasmtest.KindFunc, Index: uint32(len(funcs))},
+		{Name: "__heap_base", Kind: wasmtest.KindGlobal, Index: 0},
+	}
+	if len(data) != 0 {
+		m.Data = []wasmtest.Data{{Offset: contractDataBase, Bytes: data}}
+	}
+	return m
+}
+
+// contractCode returns the encoding of contractModule.
+func contractCode(funcs []hostImport, data contractData, body ...byte) []byte {
+	return contractModule(funcs, data, body...).Bytes()
+}
+
+// callContractCode returns a contract calling action a of callee with
+// TC_CallContract, and returning the result of the call.
+func callContractCode(callee types.Address) []byte {
+	i32 := wasmtest.I32
+	var data contractData
+	body := append(data.add(callee.String()), data.add("a")...)
+	body = append(append(body, data.add("")...), 0x10, 0)
+	return contractCode([]hostImport{
+		{"TC_CallContract", []byte{i32, i32, i32}, []byte{i32}},
+	}, data, body...)
+}
+
+func TestCallRollback(t *testing.T) {
+	i32 := wasmtest.I32
+	key := types.Keccak256Hash([]byte("k"))
+	to := types.BytesToAddress([]byte{149})
+	okCallee := types.BytesToAddress([]byte{150})
+	failCallee := types.BytesToAddress([]byte{151})
+	cState.AddBalance(failCallee, big.NewInt(10))
+
+	// the callees store, the failed one transfers and logs, then aborts
+	var data contractData
+	body := append(data.add("k"), data.add("v")...)
+	body = append(append(body, 0x10, 0), wasmtest.I32Const(0)...)
+	cState.SetCode(okCallee, contractCode([]hostImport{
+		{"TC_StorageSet", []byte{i32, i32}, nil},
+	}, data, body...))
+	data = nil
+	body = append(data.add("k"), data.add("v")...)
+	body = append(append(body, 0x10, 0), data.add(to.String())...)
+	body = append(append(body, data.add("5")...), 0x10, 1)
+	body = append(append(body, data.add("log")...), 0x10, 2, 0x1a, 0x10, 3)
+	body = append(body, wasmtest.I32Const(0)...)
+	cState.SetCode(failCallee, contractCode([]hostImport{
+		{"TC_StorageSet", []byte{i32, i32}, nil},
+		{"TC_Transfer", []byte{i32, i32}, nil},
+		{"TC_Log0", []byte{i32}, []byte{i32}},
+		{"abort", nil, nil},
+	}, data, body...))
+
+	tests := []struct {
+		caller, callee types.Address
+		fail           bool
+	}{
+		{types.BytesToAddress([]byte{152}), okCallee, false},
+		{types.BytesToAddress([]byte{153}), failCallee, true},
+	}
+	for i, tt := range tests {
+		cState.SetCode(tt.caller, callContractCode(tt.callee))
+		logs := len(cState.Logs())
+		balance := cState.GetBalance(tt.callee)
+
+		contract := vm.NewContract(cAddr.Bytes(), tt.caller.Bytes(), big.NewInt(0), 0)
+		ctx := testContext()
+		eng := vm.NewEngine(contract, 1000000, cState, log.Test(), nil, nil)
+		Inject(eng, &ctx)
+		app, err := eng.NewApp(tt.caller.String(), nil, false)
+		if err != nil {
+			t.Fatalf("#%d: new app fail: %v", i, err)
+		}
+		_, err = eng.Run(app, []byte("a|a"))
+		if (err != nil) != tt.fail {
+			t.Fatalf("#%d: wanted fail(%v), got(%v)", i, tt.fail, err)
+		}
+		if eng.Contract != contract {
+			t.Fatalf("#%d: contract not restored", i)
+		}
+		if !tt.fail {
+			if got := cState.GetState(tt.callee, key); string(got) != "v" {
+				t.Fatalf("#%d: callee storage: wanted(v), got(%s)", i, got)
+			}
+			continue
+		}
+		if got := cState.GetState(tt.callee, key); len(got) != 0 {
+			t.Fatalf("#%d: callee storage: wanted(), got(%s)", i, got)
+		}
+		if cState.GetBalance(tt.callee).Cmp(balance) != 0 || cState.GetBalance(to).Sign() != 0 {
+			t.Fatalf("#%d: transfer not reverted", i)
+		}
+		if got := len(cState.Logs()); got != logs {
+			t.Fatalf("#%d: logs: wanted(%d), got(%d)", i, logs, got)
+		}
+	}
+}
+
+// callWithValueCode returns a contract passing value of token to action a of
+// callee with TC_CallContractWithValue, and returning the result of the call.
+func callWithValueCode(callee types.Address, value string, token types.Address) []byte {
+	i32 := wasmtest.I32
+	var data contractData
+	body := append(data.add(callee.String()), data.add("a")...)
+	body = append(append(body, data.add("")...), data.add(value)...)
+	body = append(append(body, data.add(token.String())...), 0x10, 0)
+	return contractCode([]hostImport{
+		{"TC_CallContractWithValue", []byte{i32, i32, i32, i32, i32}, []byte{i32}},
+	}, data, body...)
+}
+
+func TestCallContractWithValue(t *testing.T) {
+	i32 := wasmtest.I32
+	token := types.BytesToAddress([]byte{154})
+	coinCallee := types.BytesToAddress([]byte{155})
+	tokenCallee := types.BytesToAddress([]byte{156})
+	failCallee := types.BytesToAddress([]byte{157})
+	cState.SetCode(coinCallee, contractCode([]hostImport{{"TC_GetMsgValue", nil, []byte{i32}}}, nil, 0x10, 0))
+	cState.SetCode(tokenCallee, contractCode([]hostImport{{"TC_GetMsgTokenValue", nil, []byte{i32}}}, nil, 0x10, 0))
+	cState.SetCode(failCallee, contractCode([]hostImport{{"abort", nil, nil}}, nil, append([]byte{0x10, 0}, wasmtest.I32Const(0)...)...))
+
+	w := NewWASM(testContext(), cState, nil)
+	tests := []struct {
+		caller, callee types.Address
+		value          string
+		token          types.Address
+		err            error
+	}{
+		{types.BytesToAddress([]byte{158}), coinCallee, "5", types.EmptyAddress, nil},
+		{types.BytesToAddress([]byte{159}), tokenCallee, "7", token, nil},
+		{types.BytesToAddress([]byte{160}), coinCallee, "11", types.EmptyAddress, vm.ErrBalanceNotEnough},
+	}
+	for i, tt := range tests {
+		cState.SetCode(tt.caller, callWithValueCode(tt.callee, tt.value, tt.token))
+		cState.AddTokenBalance(tt.caller, tt.token, big.NewInt(10))
+		ret, _, err := w.Call(vm.AccountRef(cAddr), tt.caller, types.EmptyAddress, []byte("a|a"), 1000000, big.NewInt(0))
+		if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+			t.Fatalf("#%d: wanted err(%v), got(%v)", i, tt.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if string(ret) != tt.value {
+			t.Fatalf("#%d: message value: wanted(%s), got(%s)", i, tt.value, ret)
+		}
+		value, _ := new(big.Int).SetString(tt.value, 10)
+		if cState.GetTokenBalance(tt.callee, tt.token).Cmp(value) != 0 || cState.GetTokenBalance(tt.caller, tt.token).Int64() != 10-value.Int64() {
+			t.Fatalf("#%d: value not transferred", i)
+		}
+	}
+
+	_, _, err := w.StaticCall(vm.AccountRef(cAddr), tests[0].caller, []byte("a|a"), 1000000)
+	if !errors.Is(err, vm.ErrWriteProtection) {
+		t.Fatalf("static call: wanted(%v), got(%v)", vm.ErrWriteProtection, err)
+	}
+
+	// run without the snapshot of WASM.Call, the transfer to the failed
+	// callee is reverted by the call itself
+	caller := types.BytesToAddress([]byte{161})
+	cState.SetCode(caller, callWithValueCode(failCallee, "5", types.EmptyAddress))
+	cState.AddBalance(caller, big.NewInt(10))
+	contract := vm.NewContract(cAddr.Bytes(), caller.Bytes(), big.NewInt(0), 0)
+	ctx := testContext()
+	eng := vm.NewEngine(contract, 1000000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
+	app, err := eng.NewApp(caller.String(), nil, false)
+	if err != nil {
+		t.Fatalf("new app fail: %v", err)
+	}
+	if _, err := eng.Run(app, []byte("a|a")); !errors.Is(err, vm.ErrContractAbort) {
+		t.Fatalf("failed callee: wanted(%v), got(%v)", vm.ErrContractAbort, err)
+	}
+	if cState.GetBalance(caller).Int64() != 10 || cState.GetBalance(failCallee).Sign() != 0 {
+		t.Fatalf("transfer to failed callee not reverted")
+	}
+
+	// a context without the transfer functions is not usable
+	ctx = Context{Time: new(big.Int).SetUint64(ctxTime), BlockNumber: big.NewInt(3456)}
+	eng = vm.NewEngine(contract, 1000000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
+	app, err = eng.NewApp(caller.String(), nil, false)
+	if err != nil {
+		t.Fatalf("new app fail: %v", err)
+	}
+	if _, err := eng.Run(app, []byte("a|a")); !errors.Is(err, ErrNoContext) {
+		t.Fatalf("no transfer: wanted(%v), got(%v)", ErrNoContext, err)
+	}
+}
+
+// callWithGasCode returns a contract calling action a of callee with gas
+// with TC_CallContractWithGas, and returning the result of the call.
+func callWithGasCode(callee types.Address, gas uint64) []byte {
+	i32, i64 := wasmtest.I32, wasmtest.I64
+	var data contractData
+	body := append(data.add(callee.String()), data.add("a")...)
+	body = append(append(body, data.add("")...), wasmtest.I64Const(int64(gas))...)
+	body = append(body, 0x10, 0)
+	return contractCode([]hostImport{
+		{"TC_CallContractWithGas", []byte{i32, i32, i32, i64}, []byte{i32}},
+	}, data, body...)
+}
+
+func TestCallContractWithGas(t *testing.T) {
+	callee := types.BytesToAddress([]byte{171})
+	spender := types.BytesToAddress([]byte{172})
+	writer := types.BytesToAddress([]byte{176})
+	cState.SetCode(callee, contractCode(nil, nil, wasmtest.I32Const(0)...))
+	// loops until it runs out of gas
+	cState.SetCode(spender, contractCode(nil, nil, append([]byte{0x03, 0x40, 0x0c, 0, 0x0b}, wasmtest.I32Const(0)...)...))
+
+	const gas = 1000000
+	w := NewWASM(testContext(), cState, nil)
+	gasUsed := func(addr, callee types.Address, stipend uint64) uint64 {
+		cState.SetCode(addr, callWithGasCode(callee, stipend))
+		ret, left, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("a|a"), gas, big.NewInt(0))
+		if err != nil {
+			t.Fatalf("stipend %d: call fail: %v", stipend, err)
+		}
+		if len(ret) != 0 {
+			t.Fatalf("stipend %d: wanted no result, got(%s)", stipend, ret)
+		}
+		if left > gas {
+			t.Fatalf("stipend %d: gas left(%d) over the gas limit", stipend, left)
+		}
+		return gas - left
+	}
+
+	// a stipend over the gas left is capped, the unused part of the stipend
+	// is given back
+	used := gasUsed(types.BytesToAddress([]byte{173}), callee, 1<<40)
+	if got := gasUsed(types.BytesToAddress([]byte{174}), callee, 100000); got != used {
+		t.Fatalf("refund: wanted(%d), got(%d)", used, got)
+	}
+
+	// running out of the stipend fails the call only
+	const stipend = 5000
+	if got := gasUsed(types.BytesToAddress([]byte{175}), spender, stipend); got < stipend || got > used+stipend {
+		t.Fatalf("out of gas: wanted(%d..%d), got(%d)", stipend, used+stipend, got)
+	}
+
+	// the errors of the engine are not a failure of the callee
+	i32 := wasmtest.I32
+	var data contractData
+	body := append(data.add("k"), data.add("v")...)
+	body = append(append(body, 0x10, 0), wasmtest.I32Const(0)...)
+	cState.SetCode(writer, contractCode([]hostImport{{"TC_StorageSet", []byte{i32, i32}, nil}}, data, body...))
+	caller := types.BytesToAddress([]byte{177})
+	cState.SetCode(caller, callWithGasCode(writer, 100000))
+	_, _, err := w.StaticCall(vm.AccountRef(cAddr), caller, []byte("a|a"), gas)
+	if !errors.Is(err, vm.ErrWriteProtection) {
+		t.Fatalf("static call: wanted(%v), got(%v)", vm.ErrWriteProtection, err)
+	}
+}
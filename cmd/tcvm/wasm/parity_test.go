@@ -0,0 +1,208 @@
+package wasm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+
+	"github.com/xunleichain/tc-wasm/mock/log"
+	"github.com/xunleichain/tc-wasm/mock/state"
+	"github.com/xunleichain/tc-wasm/mock/types"
+	"github.com/xunleichain/tc-wasm/vm"
+)
+
+// hostCall is a host function call recorded by checkParity.
+type hostCall struct {
+	Depth int
+	Name  string
+	Args  []uint64
+	Ret   uint64
+	Gas   uint64
+	Err   string
+}
+
+func (c *hostCall) String() string {
+	return fmt.Sprintf("%s(%v) = %d, depth:%d, gas:%d, err:%q", c.Name, c.Args, c.Ret, c.Depth, c.Gas, c.Err)
+}
+
+// storageWrite is a storage write recorded by checkParity.
+type storageWrite struct {
+	Addr  types.Address
+	Key   types.Hash
+	Value []byte
+}
+
+// parityRun is the outcome of one of the two runs made by checkParity.
+type parityRun struct {
+	Ret       []byte
+	GasUsed   uint64
+	Err       error
+	Writes    []storageWrite
+	Logs      []*types.Log
+	HostCalls []*hostCall
+}
+
+// parityError reports how the native run of a contract diverged from the
+// interpreted one.
+type parityError struct {
+	Field  string
+	Interp interface{}
+	Native interface{}
+
+	// HostCall is the index of the first differing host call, -1 if the two
+	// runs made the same host calls. InterpCall and NativeCall are nil when
+	// the corresponding run made fewer calls.
+	HostCall   int
+	InterpCall *hostCall
+	NativeCall *hostCall
+}
+
+func (e *parityError) Error() string {
+	msg := fmt.Sprintf("parity: %s differ: interp(%v), native(%v)", e.Field, e.Interp, e.Native)
+	if e.HostCall >= 0 {
+		msg += fmt.Sprintf(", first differing host call #%d: interp(%v), native(%v)", e.HostCall, e.InterpCall, e.NativeCall)
+	}
+	return msg
+}
+
+// checkParity runs input against the contract at addr twice, once with the
+// interpreter and once as native code compiled into dir, each on its own copy
+// of st. It returns a *parityError if the two runs disagree on return data,
+// gas used, storage writes or logs. Contracts called by the one at addr are
+// interpreted in both runs.
+func checkParity(ctx Context, st *state.StateDB, caller, addr types.Address, input []byte, gas uint64, dir string) (interp, native *parityRun, err error) {
+	interp, err = runParity(ctx, st.Copy(), caller, addr, input, gas, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	native, err = runParity(ctx, st.Copy(), caller, addr, input, gas, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	return interp, native, compareParity(interp, native)
+}
+
+func runParity(ctx Context, st *state.StateDB, caller, addr types.Address, input []byte, gas uint64, dir string) (*parityRun, error) {
+	db := &recordingStateDB{StateDB: st}
+	tracer := &hostCallTracer{}
+
+	contract := vm.NewContract(caller.Bytes(), addr.Bytes(), big.NewInt(0), gas)
+	contract.SetCallCode(addr.Bytes(), st.GetCodeHash(addr).Bytes(), st.GetCode(addr))
+	contract.Input = input
+
+	eng := vm.NewEngine(contract, gas, db, log.With("mod", "parity"), nil, nil)
+	eng.SetTracer(tracer)
+	Inject(eng, &ctx)
+	app, err := eng.NewApp(addr.String(), nil, false)
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		native, err := vm.CompileNative(app, dir)
+		if err != nil {
+			return nil, err
+		}
+		app.SetNative(native)
+		native.Close()
+	}
+
+	run := &parityRun{}
+	ret, err := eng.Run(app, input)
+	if err == nil && ret != 0 {
+		run.Ret, err = app.VM.VMemory().GetString(ret)
+	} else if errors.Is(err, vm.ErrExecutionReverted) {
+		run.Ret = eng.RevertData()
+	}
+	if dir != "" && app.IsPreRun {
+		return nil, errors.New("parity: native code not run")
+	}
+	run.Err = err
+	run.GasUsed = eng.GasUsed()
+	run.Writes = db.writes
+	run.Logs = db.logs
+	run.HostCalls = tracer.calls
+	return run, nil
+}
+
+func compareParity(interp, native *parityRun) error {
+	e := &parityError{HostCall: -1}
+	for i := 0; i < len(interp.HostCalls) || i < len(native.HostCalls); i++ {
+		var a, b *hostCall
+		if i < len(interp.HostCalls) {
+			a = interp.HostCalls[i]
+		}
+		if i < len(native.HostCalls) {
+			b = native.HostCalls[i]
+		}
+		if !reflect.DeepEqual(a, b) {
+			e.HostCall, e.InterpCall, e.NativeCall = i, a, b
+			break
+		}
+	}
+
+	switch {
+	case !bytes.Equal(interp.Ret, native.Ret):
+		e.Field, e.Interp, e.Native = "return data", string(interp.Ret), string(native.Ret)
+	case interp.GasUsed != native.GasUsed:
+		e.Field, e.Interp, e.Native = "gas used", interp.GasUsed, native.GasUsed
+	case fmt.Sprint(interp.Err) != fmt.Sprint(native.Err):
+		e.Field, e.Interp, e.Native = "error", interp.Err, native.Err
+	case !reflect.DeepEqual(interp.Writes, native.Writes):
+		e.Field, e.Interp, e.Native = "storage writes", interp.Writes, native.Writes
+	case !reflect.DeepEqual(interp.Logs, native.Logs):
+		e.Field, e.Interp, e.Native = "logs", interp.Logs, native.Logs
+	case e.HostCall >= 0:
+		e.Field, e.Interp, e.Native = "host calls", len(interp.HostCalls), len(native.HostCalls)
+	default:
+		return nil
+	}
+	return e
+}
+
+// recordingStateDB records the storage writes and logs of a run.
+type recordingStateDB struct {
+	*state.StateDB
+	writes []storageWrite
+	logs   []*types.Log
+}
+
+func (db *recordingStateDB) SetState(addr types.Address, key types.Hash, value []byte) {
+	db.writes = append(db.writes, storageWrite{Addr: addr, Key: key, Value: append([]byte(nil), value...)})
+	db.StateDB.SetState(addr, key, value)
+}
+
+func (db *recordingStateDB) AddLog(l *types.Log) {
+	db.StateDB.AddLog(l)
+	db.logs = append(db.logs, l)
+}
+
+// hostCallTracer is a vm.Tracer recording host calls.
+type hostCallTracer struct {
+	calls []*hostCall
+}
+
+func (t *hostCallTracer) CaptureEnter(depth int, from types.Address, app string, action, args string, gas uint64) {
+}
+
+func (t *hostCallTracer) CaptureExit(depth int, ret uint64, output []byte, gasUsed uint64, err error) {
+}
+
+func (t *hostCallTracer) CaptureHostCall(depth int, name string, args []uint64, ret uint64, gas uint64, err error) {
+	call := &hostCall{
+		Depth: depth,
+		Name:  name,
+		Args:  append([]uint64(nil), args...),
+		Ret:   ret,
+		Gas:   gas,
+	}
+	if err != nil {
+		call.Err = err.Error()
+	}
+	t.calls = append(t.calls, call)
+}
+
+func (t *hostCallTracer) CaptureMemoryGrow(depth int, oldSize, newSize int) {}
+
+func (t *hostCallTracer) CaptureFault(depth int, err error) {}
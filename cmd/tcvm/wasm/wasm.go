@@ -2,6 +2,7 @@ package wasm
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/big"
 
@@ -144,21 +145,52 @@ func run(wasm *WASM, c types.Contract, input []byte) ([]byte, uint64, error) {
 
 	addr := contract.CodeAddr
 
-	eng := vm.NewEngine(contract, localMaxGas, wasm.StateDB, log.With("mod", "wasm"))
+	eng := vm.NewEngine(contract, localMaxGas, wasm.StateDB, log.With("mod", "wasm"), wasm.appCache, wasm.limits)
 	eng.SetTrace(false)
+	eng.SetReadOnly(wasm.readOnly)
+	eng.SetReentrancyPolicy(wasm.reentrancy)
+	Inject(eng, &wasm.Context)
+	if wasm.env != nil {
+		eng.SetEnvTable(wasm.env)
+	}
+	if wasm.tracer != nil {
+		eng.SetTracer(wasm.tracer)
+	}
+	if wasm.gasSchedule != nil {
+		eng.SetGasSchedule(wasm.gasSchedule)
+	}
+	if contract.CreateCall && wasm.determinism != nil {
+		if err := vm.CheckDeterminism(contract.Code, eng.EnvTable(), *wasm.determinism); err != nil {
+			log.Error("WASM vm.CheckDeterminism", "err", err, "contract", addr.String())
+			return nil, contract.Gas, err
+		}
+	}
 	app, err := eng.NewApp(addr.String(), nil, false)
 	if err != nil {
 		if err == vm.ErrContractNoCode {
 			return nil, contract.Gas, nil
 		}
 		log.Error("WASM eng.NewApp", "err", err, "contract", addr.String())
+		if err == vm.ErrInvalidLimits {
+			return nil, contract.Gas, err
+		}
+		switch err.(type) {
+		case *vm.ABIError, *vm.LimitError:
+			return nil, contract.Gas, err
+		}
 		return nil, contract.Gas, fmt.Errorf("WASM eng.NewApp,err:%v", err)
 	}
 
 	fnIndex := app.GetExportFunction(vm.APPEntry)
-	if fnIndex < 0 {
+	if fnIndex < 0 && !app.ExportDispatch() {
 		return []byte(""), contract.Gas, fmt.Errorf("GetExportFunction(APPEntry) fail")
 	}
+	if contract.CreateCall {
+		if err := app.CheckABI(); err != nil {
+			log.Error("WASM app.CheckABI", "err", err, "contract", addr.String())
+			return nil, contract.Gas, err
+		}
+	}
 
 	ret, err := eng.Run(app, input)
 	gasused, modgas := new(big.Int).DivMod(new(big.Int).SetUint64(eng.GasUsed()), new(big.Int).SetUint64(wasm.WasmGasRate), big.NewInt(0))
@@ -169,13 +201,16 @@ func run(wasm *WASM, c types.Contract, input []byte) ([]byte, uint64, error) {
 
 	gas := contract.Gas - gasused.Uint64() - subModGas
 
+	if errors.Is(err, vm.ErrExecutionReverted) {
+		log.Debug("WASM eng.Run reverted", "reason", string(eng.RevertData()), "gas", gas)
+		return eng.RevertData(), gas, err
+	}
 	if err != nil {
 		log.Error("WASM eng.Run ret:", "ret", ret, "gas", gas, "err", err)
 		return nil, gas, err
 	}
 
-	// @Todo: Bugs here.
-	retData, err := app.VM.VMemory().GetString(ret)
+	retData, err := eng.Output(app, ret)
 	log.Debug("WASM eng.Run ret:", "ret", ret, "retData", string(retData), "gas", gas, "eng.GasUsed()", eng.GasUsed(), "err", err)
 	if err != nil {
 		return nil, gas, err
@@ -193,9 +228,37 @@ type WASM struct {
 	// StateDB gives access to the underlying state
 	StateDB types.StateDB
 
+	// env holds the host functions exposed to contracts, ChainEnvTable if nil.
 	env *vm.EnvTable
 	eng *vm.Engine
 	app *vm.APP
+
+	// readOnly is set while a StaticCall is in progress, every engine
+	// started meanwhile runs in read-only mode.
+	readOnly bool
+
+	// tracer, if set, is attached to every engine started by the WASM.
+	tracer vm.Tracer
+
+	// appCache keeps the parsed contracts, vm.DefaultAppCache if nil.
+	appCache *vm.AppCache
+
+	// limits caps the resources of the contracts, vm.DefaultLimits if nil.
+	limits *vm.Limits
+
+	// gasSchedule, if set, is the gas schedule the contracts are
+	// instrumented with, see vm.Instrument.
+	gasSchedule *vm.GasSchedule
+
+	// determinism, if set, is checked by the contracts being created.
+	determinism *vm.DeterminismPolicy
+
+	// reentrancy is the reentrancy policy of every engine started by the
+	// WASM.
+	reentrancy vm.ReentrancyPolicy
+
+	// status is the outcome of the last call, see Status.
+	status vm.Status
 }
 
 // NewWASM returns a new WASM. The returned WASM is not thread safe and should
@@ -209,6 +272,57 @@ func NewWASM(c types.Context, statedb types.StateDB, vmc types.VmConfig) *WASM {
 	}
 }
 
+// SetTracer sets the tracer of the contracts run by Call, CallCode,
+// DelegateCall, StaticCall and Create, e.g. a vm.CallTracer.
+func (wasm *WASM) SetTracer(tracer vm.Tracer) {
+	wasm.tracer = tracer
+}
+
+// SetEnvTable sets the host functions exposed to the contracts run by the WASM.
+func (wasm *WASM) SetEnvTable(env *vm.EnvTable) {
+	wasm.env = env
+}
+
+// SetAppCache sets the cache of parsed contracts used by the WASM.
+func (wasm *WASM) SetAppCache(cache *vm.AppCache) {
+	wasm.appCache = cache
+}
+
+// SetLimits sets the resource limits of the contracts run by the WASM.
+func (wasm *WASM) SetLimits(limits *vm.Limits) {
+	wasm.limits = limits
+}
+
+// SetGasSchedule sets the gas schedule the contracts run by the WASM are
+// instrumented with, see vm.Instrument. If it is nil, the default, the
+// interpreter charges their instructions.
+func (wasm *WASM) SetGasSchedule(schedule *vm.GasSchedule) {
+	wasm.gasSchedule = schedule
+}
+
+// SetDeterminism sets the policy checked by the contracts created by the
+// WASM, see vm.CheckDeterminism. No check is made if policy is nil.
+func (wasm *WASM) SetDeterminism(policy *vm.DeterminismPolicy) {
+	wasm.determinism = policy
+}
+
+// SetReentrancyPolicy sets how the contracts run by the WASM may be called
+// again while they are running, vm.ReentrancyForbidSelf by default.
+func (wasm *WASM) SetReentrancyPolicy(policy vm.ReentrancyPolicy) {
+	wasm.reentrancy = policy
+}
+
+// Status returns the outcome of the last Call, CallCode, DelegateCall,
+// StaticCall or Create as a numeric code to be stored in receipts, see
+// vm.StatusOf.
+func (wasm *WASM) Status() vm.Status {
+	return wasm.status
+}
+
+func (wasm *WASM) setStatus(err *error) {
+	wasm.status = vm.StatusOf(*err)
+}
+
 // reset
 //func (wasm *WASM) Reset(origin types.Address, gasPrice *big.Int, nonce uint64) {
 func (wasm *WASM) Reset(msg types.Message) {
@@ -231,6 +345,7 @@ func (wasm *WASM) Cancel() {}
 // the necessary steps to create accounts and reverses the state in case of an
 // execution error or failed value transfer.
 func (wasm *WASM) Call(c types.ContractRef, addr, token types.Address, input []byte, gas uint64, value *big.Int) (ret []byte, leftOverGas uint64, err error) {
+	defer wasm.setStatus(&err)
 	caller := c.(vm.ContractRef)
 
 	// Fail if we're trying to transfer more than the available balance
@@ -260,7 +375,7 @@ func (wasm *WASM) Call(c types.ContractRef, addr, token types.Address, input []b
 	// when we're in homestead this also counts for code storage gas errors.
 	if err != nil {
 		wasm.StateDB.RevertToSnapshot(snapshot)
-		if err != vm.ErrExecutionReverted {
+		if !errors.Is(err, vm.ErrExecutionReverted) {
 			contract.UseGas(contract.Gas)
 		}
 	}
@@ -275,6 +390,7 @@ func (wasm *WASM) Call(c types.ContractRef, addr, token types.Address, input []b
 // CallCode differs from Call in the sense that it executes the given address'
 // code with the caller as context.
 func (wasm *WASM) CallCode(c types.ContractRef, addr types.Address, input []byte, gas uint64, value *big.Int) (ret []byte, leftOverGas uint64, err error) {
+	defer wasm.setStatus(&err)
 	caller := c.(vm.ContractRef)
 
 	// Fail if we're trying to transfer more than the available balance
@@ -297,7 +413,7 @@ func (wasm *WASM) CallCode(c types.ContractRef, addr types.Address, input []byte
 	contract.Gas = leftOverGas
 	if err != nil {
 		wasm.StateDB.RevertToSnapshot(snapshot)
-		if err != vm.ErrExecutionReverted {
+		if !errors.Is(err, vm.ErrExecutionReverted) {
 			contract.UseGas(contract.Gas)
 		}
 	}
@@ -310,6 +426,7 @@ func (wasm *WASM) CallCode(c types.ContractRef, addr types.Address, input []byte
 // DelegateCall differs from CallCode in the sense that it executes the given address'
 // code with the caller as context and the caller is set to the caller of the caller.
 func (wasm *WASM) DelegateCall(c types.ContractRef, addr types.Address, input []byte, gas uint64) (ret []byte, leftOverGas uint64, err error) {
+	defer wasm.setStatus(&err)
 	caller := c.(vm.ContractRef)
 
 	var (
@@ -326,7 +443,7 @@ func (wasm *WASM) DelegateCall(c types.ContractRef, addr types.Address, input []
 	contract.Gas = leftOverGas
 	if err != nil {
 		wasm.StateDB.RevertToSnapshot(snapshot)
-		if err != vm.ErrExecutionReverted {
+		if !errors.Is(err, vm.ErrExecutionReverted) {
 			contract.UseGas(contract.Gas)
 		}
 	}
@@ -338,15 +455,16 @@ func (wasm *WASM) DelegateCall(c types.ContractRef, addr types.Address, input []
 // Opcodes that attempt to perform such modifications will result in exceptions
 // instead of performing the modifications.
 func (wasm *WASM) StaticCall(c types.ContractRef, addr types.Address, input []byte, gas uint64) (ret []byte, leftOverGas uint64, err error) {
+	defer wasm.setStatus(&err)
 	caller := c.(vm.ContractRef)
 
 	// Make sure the readonly is only set if we aren't in readonly yet
 	// this makes also sure that the readonly flag isn't removed for
 	// child calls.
-	// if !wasm.interpreter.readOnly {
-	// 	wasm.interpreter.readOnly = true
-	// 	defer func() { wasm.interpreter.readOnly = false }()
-	// }
+	if !wasm.readOnly {
+		wasm.readOnly = true
+		defer func() { wasm.readOnly = false }()
+	}
 
 	var (
 		to       = vm.AccountRef(addr)
@@ -366,7 +484,7 @@ func (wasm *WASM) StaticCall(c types.ContractRef, addr types.Address, input []by
 	contract.Gas = leftOverGas
 	if err != nil {
 		wasm.StateDB.RevertToSnapshot(snapshot)
-		if err != vm.ErrExecutionReverted {
+		if !errors.Is(err, vm.ErrExecutionReverted) {
 			contract.UseGas(contract.Gas)
 		}
 	}
@@ -375,6 +493,7 @@ func (wasm *WASM) StaticCall(c types.ContractRef, addr types.Address, input []by
 
 // Create creates a new contract using code as deployment code.
 func (wasm *WASM) Create(c types.ContractRef, data []byte, gas uint64, value *big.Int) (ret []byte, contractAddr types.Address, leftOverGas uint64, err error) {
+	defer wasm.setStatus(&err)
 	caller := c.(vm.ContractRef)
 
 	if !wasm.CanTransfer(wasm.StateDB, caller.Address(), types.EmptyAddress, value) {
@@ -422,13 +541,17 @@ func (wasm *WASM) Create(c types.ContractRef, data []byte, gas uint64, value *bi
 	contract.CreateCall = true
 
 	// TODO :wasm not found code ,return err,create fail,
-	ret, leftOverGas, err = run(wasm, contract, contract.Input)
+	reason, leftOverGas, err := run(wasm, contract, contract.Input)
 
 	ret = code
 	contract.Gas = leftOverGas
 
 	// check whether the max code size has been exceeded
-	maxCodeSizeExceeded := len(ret) > vm.MaxCodeSize
+	limits := wasm.limits
+	if limits == nil {
+		limits = &vm.DefaultLimits
+	}
+	maxCodeSizeExceeded := len(ret) > limits.CodeSize
 	// if the contract creation ran successfully and no errors were returned
 	// calculate the gas required to store the code. If the code could not
 	// be stored due to not enough gas set an error and let it be handled
@@ -448,7 +571,7 @@ func (wasm *WASM) Create(c types.ContractRef, data []byte, gas uint64, value *bi
 	// when we're in homestead this also counts for code storage gas errors.
 	if maxCodeSizeExceeded || err != nil {
 		wasm.StateDB.RevertToSnapshot(snapshot)
-		if err != vm.ErrExecutionReverted {
+		if !errors.Is(err, vm.ErrExecutionReverted) {
 			contract.UseGas(contract.Gas)
 		}
 	}
@@ -456,6 +579,9 @@ func (wasm *WASM) Create(c types.ContractRef, data []byte, gas uint64, value *bi
 	if maxCodeSizeExceeded && err == nil {
 		err = vm.ErrMaxCodeSizeExceeded
 	}
+	if errors.Is(err, vm.ErrExecutionReverted) {
+		ret = reason
+	}
 	return ret, contractAddr, contract.Gas, err
 }
 
@@ -465,7 +591,6 @@ func (wasm *WASM) Create(c types.ContractRef, data []byte, gas uint64, value *bi
 func (wasm *WASM) Upgrade(caller types.ContractRef, contractAddr types.Address, code []byte) {
 	wasm.StateDB.SetCode(contractAddr, code)
 	wasm.StateDB.SetNonce(wasm.Context.Origin, wasm.Context.Nonce+1)
-	vm.AppCache.Delete(contractAddr.String())
 }
 
 //Token
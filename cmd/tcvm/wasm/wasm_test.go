@@ -3,13 +3,18 @@ package wasm
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io/ioutil"
 	"math/big"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/xunleichain/tc-wasm/mock/log"
 	"github.com/xunleichain/tc-wasm/mock/state"
 	"github.com/xunleichain/tc-wasm/mock/types"
+	"github.com/xunleichain/tc-wasm/mock/wasmtest"
 	"github.com/xunleichain/tc-wasm/vm"
 )
 
@@ -101,8 +106,8 @@ func TestCallContract(t *testing.T) {
 		Token:       addr1,
 		BlockNumber: big.NewInt(3456),
 	}
-	eng := vm.NewEngine(contract, 1000000, cState, log.Test())
-	Inject(&ctx, cState)
+	eng := vm.NewEngine(contract, 1000000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
 	app, err := eng.NewApp(addr1.String(), nil, false)
 	if err != nil {
 		t.Logf("new app fail: err: %v", err)
@@ -140,8 +145,8 @@ func TestNotify(t *testing.T) {
 		Token:       addr,
 		BlockNumber: big.NewInt(3456),
 	}
-	eng := vm.NewEngine(contract, 100000, cState, log.Test())
-	Inject(&ctx, cState)
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
 	app, err := eng.NewApp(addr.String(), nil, false)
 	if err != nil {
 		t.Logf("new app fail: err: %v", err)
@@ -176,8 +181,8 @@ func TestToken(t *testing.T) {
 		Token:       addr,
 		BlockNumber: big.NewInt(3456),
 	}
-	eng := vm.NewEngine(contract, 100000, cState, log.Test())
-	Inject(&ctx, cState)
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
 	app, err := eng.NewApp(addr.String(), nil, false)
 	if err != nil {
 		t.Logf("new app fail: err: %v", err)
@@ -208,8 +213,8 @@ func TestMalloc(t *testing.T) {
 		Token:       addr,
 		BlockNumber: big.NewInt(3456),
 	}
-	eng := vm.NewEngine(contract, 100000, cState, log.Test())
-	Inject(&ctx, cState)
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
 	app, err := eng.NewApp(addr.String(), nil, false)
 	if err != nil {
 		t.Logf("new app fail: err: %v", err)
@@ -240,8 +245,8 @@ func TestPrints(t *testing.T) {
 		Token:       addr,
 		BlockNumber: big.NewInt(3456),
 	}
-	eng := vm.NewEngine(contract, 100000, cState, log.Test())
-	Inject(&ctx, cState)
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
 	app, err := eng.NewApp(addr.String(), nil, false)
 	if err != nil {
 		t.Logf("new app fail: err: %v", err)
@@ -272,8 +277,8 @@ func TestLog(t *testing.T) {
 		Token:       addr,
 		BlockNumber: big.NewInt(3456),
 	}
-	eng := vm.NewEngine(contract, 100000, cState, log.Test())
-	Inject(&ctx, cState)
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
 	app, err := eng.NewApp(addr.String(), nil, false)
 	if err != nil {
 		t.Logf("new app fail: err: %v", err)
@@ -310,8 +315,8 @@ func TestSelfDestruct(t *testing.T) {
 		Token:       addr,
 		BlockNumber: big.NewInt(3456),
 	}
-	eng := vm.NewEngine(contract, 100000, cState, log.Test())
-	Inject(&ctx, cState)
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
 	app, err := eng.NewApp(addr.String(), nil, false)
 	if err != nil {
 		t.Logf("new app fail: err: %v", err)
@@ -350,8 +355,8 @@ func TestSelfAddress(t *testing.T) {
 		Token:       addr,
 		BlockNumber: big.NewInt(3456),
 	}
-	eng := vm.NewEngine(contract, 100000, cState, log.Test())
-	Inject(&ctx, cState)
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
 	app, err := eng.NewApp(addr.String(), nil, false)
 	if err != nil {
 		t.Logf("new app fail: err: %v", err)
@@ -382,8 +387,8 @@ func TestGetBalance(t *testing.T) {
 		Token:       addr,
 		BlockNumber: big.NewInt(3456),
 	}
-	eng := vm.NewEngine(contract, 100000, cState, log.Test())
-	Inject(&ctx, cState)
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
 	app, err := eng.NewApp(addr.String(), nil, false)
 	if err != nil {
 		t.Logf("new app fail: err: %v", err)
@@ -414,8 +419,8 @@ func TestEcrecover(t *testing.T) {
 		Token:       addr,
 		BlockNumber: big.NewInt(3456),
 	}
-	eng := vm.NewEngine(contract, 100000, cState, log.Test())
-	Inject(&ctx, cState)
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
 	app, err := eng.NewApp(addr.String(), nil, false)
 	if err != nil {
 		t.Logf("new app fail: err: %v", err)
@@ -446,8 +451,8 @@ func TestRipemd160(t *testing.T) {
 		Token:       addr,
 		BlockNumber: big.NewInt(3456),
 	}
-	eng := vm.NewEngine(contract, 100000, cState, log.Test())
-	Inject(&ctx, cState)
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
 	app, err := eng.NewApp(addr.String(), nil, false)
 	if err != nil {
 		t.Logf("new app fail: err: %v", err)
@@ -478,8 +483,8 @@ func TestSha256(t *testing.T) {
 		Token:       addr,
 		BlockNumber: big.NewInt(3456),
 	}
-	eng := vm.NewEngine(contract, 100000, cState, log.Test())
-	Inject(&ctx, cState)
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
 	app, err := eng.NewApp(addr.String(), nil, false)
 	if err != nil {
 		t.Logf("new app fail: err: %v", err)
@@ -510,8 +515,8 @@ func TestKeccak256(t *testing.T) {
 		Token:       addr,
 		BlockNumber: big.NewInt(3456),
 	}
-	eng := vm.NewEngine(contract, 100000, cState, log.Test())
-	Inject(&ctx, cState)
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
 	app, err := eng.NewApp(addr.String(), nil, false)
 	if err != nil {
 		t.Logf("new app fail: err: %v", err)
@@ -544,8 +549,8 @@ func TestTransfer(t *testing.T) {
 		Token:       addr,
 		BlockNumber: big.NewInt(3456),
 	}
-	eng := vm.NewEngine(contract, 100000, cState, log.Test())
-	Inject(&ctx, cState)
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
 	app, err := eng.NewApp(addr.String(), nil, false)
 	if err != nil {
 		t.Logf("new app fail: err: %v", err)
@@ -559,3 +564,1229 @@ func TestTransfer(t *testing.T) {
 	t.Logf("to account balance: %d after exec contract method", cState.GetBalance(types.HexToAddress("0x0000000000000000000000000000000000000001")))
 	return
 }
+
+func TestStaticCall(t *testing.T) {
+	wasmFile := "../../../testdata/transfer.wasm"
+	code, err := ioutil.ReadFile(wasmFile)
+	if err != nil {
+		t.Logf("read wasm code fail: %v", err)
+		return
+	}
+	addr := types.BytesToAddress([]byte{99})
+	to := types.HexToAddress("0x0000000000000000000000000000000000000001")
+	cState.AddBalance(addr, big.NewInt(int64(10000)))
+	cState.SetCode(addr, code)
+
+	ctx := testContext()
+	w := NewWASM(ctx, cState, nil)
+
+	fromBalance := cState.GetBalance(addr)
+	toBalance := cState.GetBalance(to)
+	input := []byte("a|a")
+	_, _, err = w.StaticCall(vm.AccountRef(cAddr), addr, input, 100000)
+	if !errors.Is(err, vm.ErrWriteProtection) {
+		t.Fatalf("static call: wanted err(%v), got(%v)", vm.ErrWriteProtection, err)
+	}
+	if cState.GetBalance(addr).Cmp(fromBalance) != 0 || cState.GetBalance(to).Cmp(toBalance) != 0 {
+		t.Fatalf("static call changed balances")
+	}
+
+	_, _, err = w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, input, 100000, big.NewInt(0))
+	if err != nil {
+		t.Fatalf("call fail: %v", err)
+	}
+	if cState.GetBalance(to).Cmp(new(big.Int).Add(toBalance, big.NewInt(125))) != 0 {
+		t.Fatalf("call did not transfer")
+	}
+}
+
+type testTracer struct {
+	enters    []string
+	exits     int
+	hostCalls map[string]int
+	t         *testing.T
+}
+
+func (tr *testTracer) CaptureEnter(depth int, from types.Address, app string, action, args string, gas uint64) {
+	tr.t.Logf("enter: depth=%d from=%s app=%s action=%s gas=%d", depth, from.String(), app, action, gas)
+	tr.enters = append(tr.enters, app)
+}
+
+func (tr *testTracer) CaptureExit(depth int, ret uint64, output []byte, gasUsed uint64, err error) {
+	tr.t.Logf("exit: depth=%d ret=%d output=%s gasUsed=%d err=%v", depth, ret, string(output), gasUsed, err)
+	tr.exits++
+}
+
+func (tr *testTracer) CaptureHostCall(depth int, name string, args []uint64, ret uint64, gas uint64, err error) {
+	tr.hostCalls[name]++
+}
+
+func (tr *testTracer) CaptureMemoryGrow(depth int, oldSize, newSize int) {
+	tr.t.Logf("memory grow: depth=%d %d -> %d", depth, oldSize, newSize)
+}
+
+func (tr *testTracer) CaptureFault(depth int, err error) {
+	tr.t.Logf("fault: depth=%d err=%v", depth, err)
+}
+
+func TestTracer(t *testing.T) {
+	wasmContractFile1 := "../../../testdata/contract.wasm"
+	contractCode1, err := ioutil.ReadFile(wasmContractFile1)
+	if err != nil {
+		t.Logf("read wasm code fail: %v", err)
+		return
+	}
+
+	wasmContractFile2 := "../../../testdata/contract1.wasm"
+	contractCode2, err := ioutil.ReadFile(wasmContractFile2)
+	if err != nil {
+		t.Logf("read wasm code fail: %v", err)
+		return
+	}
+
+	wasmContractFile3 := "../../../testdata/contract2.wasm"
+	contractCode3, err := ioutil.ReadFile(wasmContractFile3)
+	if err != nil {
+		t.Logf("read wasm code fail: %v", err)
+		return
+	}
+
+	addr1 := types.BytesToAddress([]byte{114})
+	cState.SetCode(addr1, contractCode1)
+
+	addr2 := types.BytesToAddress([]byte{115})
+	cState.SetCode(addr2, contractCode2)
+
+	addr3 := types.BytesToAddress([]byte{116})
+	cState.SetCode(addr3, contractCode3)
+
+	contract := vm.NewContract(cAddr.Bytes(), addr1.Bytes(), big.NewInt(100), 0)
+	contract.CodeAddr = &addr1
+	ctx := Context{
+		Time:        new(big.Int).SetUint64(ctxTime),
+		Token:       addr1,
+		BlockNumber: big.NewInt(3456),
+	}
+	eng := vm.NewEngine(contract, 1000000, cState, log.Test(), nil, nil)
+	tracer := &testTracer{hostCalls: make(map[string]int), t: t}
+	eng.SetTracer(tracer)
+	Inject(eng, &ctx)
+	app, err := eng.NewApp(addr1.String(), nil, false)
+	if err != nil {
+		t.Fatalf("new app fail: err: %v", err)
+	}
+	action := "none"
+	params := "{\"contract1\":\"0x0000000000000000000000000000000000000073\",\"contract2\":\"0x0000000000000000000000000000000000000074\"}"
+	input := []byte(action + "|" + params)
+	eng.Contract.Input = input
+	ret, err := eng.Run(app, input)
+	t.Logf("ret: %d, err: %v, host calls: %v", ret, err, tracer.hostCalls)
+
+	if len(tracer.enters) < 2 || tracer.enters[0] != addr1.String() {
+		t.Fatalf("unexpected frames: %v", tracer.enters)
+	}
+	if tracer.exits != len(tracer.enters) {
+		t.Fatalf("enter/exit mismatch: %d/%d", len(tracer.enters), tracer.exits)
+	}
+	if tracer.hostCalls["TC_CallContract"] == 0 {
+		t.Fatalf("TC_CallContract not traced: %v", tracer.hostCalls)
+	}
+}
+
+func TestCallTracer(t *testing.T) {
+	wasmContractFile1 := "../../../testdata/contract.wasm"
+	contractCode1, err := ioutil.ReadFile(wasmContractFile1)
+	if err != nil {
+		t.Logf("read wasm code fail: %v", err)
+		return
+	}
+
+	wasmContractFile2 := "../../../testdata/contract1.wasm"
+	contractCode2, err := ioutil.ReadFile(wasmContractFile2)
+	if err != nil {
+		t.Logf("read wasm code fail: %v", err)
+		return
+	}
+
+	wasmContractFile3 := "../../../testdata/contract2.wasm"
+	contractCode3, err := ioutil.ReadFile(wasmContractFile3)
+	if err != nil {
+		t.Logf("read wasm code fail: %v", err)
+		return
+	}
+
+	addr1 := types.BytesToAddress([]byte{114})
+	cState.SetCode(addr1, contractCode1)
+
+	addr2 := types.BytesToAddress([]byte{115})
+	cState.SetCode(addr2, contractCode2)
+
+	addr3 := types.BytesToAddress([]byte{116})
+	cState.SetCode(addr3, contractCode3)
+
+	ctx := testContext()
+	w := NewWASM(ctx, cState, nil)
+	tracer := vm.NewCallTracer()
+	w.SetTracer(tracer)
+
+	params := "{\"contract1\":\"0x0000000000000000000000000000000000000073\",\"contract2\":\"0x0000000000000000000000000000000000000074\"}"
+	_, _, err = w.Call(vm.AccountRef(cAddr), addr1, types.EmptyAddress, []byte("none|"+params), 1000000, big.NewInt(0))
+	if err != nil {
+		t.Fatalf("call fail: %v", err)
+	}
+
+	result, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("tracer result fail: %v", err)
+	}
+	t.Logf("trace: %s", string(result))
+
+	root := tracer.Result()
+	if root == nil || root.To != addr1.String() || root.From != cAddr.String() || root.Action != "none" {
+		t.Fatalf("unexpected root frame: %+v", root)
+	}
+	if len(root.Calls) != 6 {
+		t.Fatalf("wanted 6 nested calls, got %d", len(root.Calls))
+	}
+	for _, call := range root.Calls[2:] {
+		if len(call.Calls) != 1 || call.Calls[0].To != addr3.String() {
+			t.Fatalf("unexpected nested call: %+v", call)
+		}
+	}
+}
+
+func TestParity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcvm-parity")
+	if err != nil {
+		t.Fatalf("create temp dir fail: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		file  string
+		input string
+	}{
+		{"transfer.wasm", "a|a"},
+		{"log.wasm", "a|a"},
+		{"notify.wasm", "a|a"},
+		{"malloc.wasm", "a|a"},
+		{"keccak256.wasm", "a|a"},
+		{"selfaddress.wasm", "a|a"},
+		{"getbalance.wasm", "a|a"},
+	}
+
+	for i, c := range cases {
+		code, err := ioutil.ReadFile("../../../testdata/" + c.file)
+		if err != nil {
+			t.Fatalf("read wasm code fail: %v", err)
+		}
+
+		st, _ := state.New()
+		addr := types.BytesToAddress([]byte{0x80 + byte(i)})
+		st.SetCode(addr, code)
+		st.AddBalance(addr, big.NewInt(10000))
+		st.AddBalance(cAddr, big.NewInt(10000))
+		ctx := testContext()
+
+		interp, native, err := checkParity(ctx, st, cAddr, addr, []byte(c.input), 1000000, dir)
+		if err != nil {
+			t.Fatalf("%s: %v", c.file, err)
+		}
+		t.Logf("%s: ret: %q, gas used: %d, host calls: %d, err: %v", c.file, interp.Ret, interp.GasUsed, len(interp.HostCalls), interp.Err)
+		if len(native.HostCalls) != len(interp.HostCalls) {
+			t.Fatalf("%s: host calls differ", c.file)
+		}
+	}
+}
+
+func TestAppCache(t *testing.T) {
+	var codes [][]byte
+	for _, file := range []string{"selfaddress.wasm", "keccak256.wasm"} {
+		code, err := ioutil.ReadFile("../../../testdata/" + file)
+		if err != nil {
+			t.Logf("read wasm code fail: %v", err)
+			return
+		}
+		codes = append(codes, code)
+	}
+
+	addr1 := types.BytesToAddress([]byte{130})
+	addr2 := types.BytesToAddress([]byte{131})
+	addr3 := types.BytesToAddress([]byte{132})
+	cState.SetCode(addr1, codes[0])
+	cState.SetCode(addr2, codes[0])
+	cState.SetCode(addr3, codes[1])
+
+	cache := vm.NewAppCache(1, 0)
+	contract := vm.NewContract(cAddr.Bytes(), addr1.Bytes(), big.NewInt(0), 0)
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), cache, nil)
+
+	for _, addr := range []types.Address{addr1, addr2, addr3, addr1} {
+		app, err := eng.NewApp(addr.String(), nil, false)
+		if err != nil {
+			t.Fatalf("new app fail: %v", err)
+		}
+		if app.Name != addr.String() {
+			t.Fatalf("app name: wanted(%s), got(%s)", addr.String(), app.Name)
+		}
+	}
+
+	stats := cache.Stats()
+	t.Logf("cache stats: %+v", stats)
+	if stats.Hits != 1 || stats.Misses != 3 || stats.Evictions != 2 || stats.Entries != 1 {
+		t.Fatalf("unexpected cache stats: %+v", stats)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	var codes [][]byte
+	for _, file := range []string{"selfaddress.wasm", "keccak256.wasm"} {
+		code, err := ioutil.ReadFile("../../../testdata/" + file)
+		if err != nil {
+			t.Logf("read wasm code fail: %v", err)
+			return
+		}
+		codes = append(codes, code)
+	}
+
+	addr := types.BytesToAddress([]byte{133})
+	cState.SetCode(addr, codes[0])
+
+	ctx := testContext()
+	w := NewWASM(ctx, cState, nil)
+
+	ret, _, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("a|a"), 100000, big.NewInt(0))
+	if err != nil {
+		t.Fatalf("call fail: %v", err)
+	}
+	if string(ret) != addr.String() {
+		t.Fatalf("before upgrade: wanted(%s), got(%s)", addr.String(), string(ret))
+	}
+
+	// Replace the code behind the engine's back, the cache must not serve
+	// the old contract.
+	cState.SetCode(addr, codes[1])
+	ret, _, err = w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("a|a"), 100000, big.NewInt(0))
+	if err != nil {
+		t.Fatalf("call fail: %v", err)
+	}
+	if string(ret) == addr.String() {
+		t.Fatalf("after upgrade: stale code served")
+	}
+	t.Logf("after upgrade: %s", string(ret))
+}
+
+func TestConcurrentEngines(t *testing.T) {
+	var codes [][]byte
+	for _, file := range []string{"selfaddress.wasm", "getbalance.wasm", "keccak256.wasm", "transfer.wasm"} {
+		code, err := ioutil.ReadFile("../../../testdata/" + file)
+		if err != nil {
+			t.Logf("read wasm code fail: %v", err)
+			return
+		}
+		codes = append(codes, code)
+	}
+
+	errs := make(chan error, 16)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			st, _ := state.New()
+			addr := types.BytesToAddress([]byte{0x90, byte(i)})
+			st.SetCode(addr, codes[i%len(codes)])
+			st.AddBalance(addr, big.NewInt(10000))
+			st.AddBalance(cAddr, big.NewInt(10000))
+
+			ctx := testContext()
+			ctx.BlockNumber = big.NewInt(int64(i))
+			w := NewWASM(ctx, st, nil)
+			_, _, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("a|a"), 100000, big.NewInt(0))
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("call fail: %v", err)
+		}
+	}
+}
+
+type countGetBalance struct {
+	TCGetBalance
+	calls int
+}
+
+func (f *countGetBalance) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	f.calls++
+	return f.TCGetBalance.Call(index, ops, args)
+}
+
+func TestEnvTable(t *testing.T) {
+	code, err := ioutil.ReadFile("../../../testdata/getbalance.wasm")
+	if err != nil {
+		t.Logf("read wasm code fail: %v", err)
+		return
+	}
+	addr := types.BytesToAddress([]byte{134})
+	cState.SetCode(addr, code)
+
+	ctx := Context{
+		Time:        new(big.Int).SetUint64(ctxTime),
+		BlockNumber: big.NewInt(3456),
+	}
+	getBalance := &countGetBalance{}
+	custom := vm.NewHostModule("custom")
+	custom.Register("TC_GetBalance", "(i)i", getBalance)
+
+	tables := []struct {
+		env  *vm.EnvTable
+		fail bool
+	}{
+		{vm.DefaultEnvTable(), true},
+		{ChainEnvTable(), false},
+		{vm.NewEnvTable(vm.BaseModules()...), true},
+		{vm.NewEnvTable(append(vm.BaseModules(), ChainModule, custom)...), false},
+	}
+	for i, tt := range tables {
+		contract := vm.NewContract(cAddr.Bytes(), addr.Bytes(), big.NewInt(0), 0)
+		contract.Input = []byte("a|a")
+		eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+		Inject(eng, &ctx)
+		eng.SetEnvTable(tt.env)
+
+		app, err := eng.NewApp(addr.String(), nil, false)
+		if tt.fail {
+			if err == nil {
+				t.Fatalf("#%d: new app should fail", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("#%d: new app fail: %v", i, err)
+		}
+		if _, err := eng.Run(app, contract.Input); err != nil {
+			t.Fatalf("#%d: run fail: %v", i, err)
+		}
+	}
+	if getBalance.calls == 0 {
+		t.Fatalf("custom TC_GetBalance not called")
+	}
+}
+
+// importCode returns a contract with an empty entry of type (), importing
+// module.field with the given parameter and result types.
+func importCode(module, field string, params, results []byte) []byte {
+	m := contractModule([]hostImport{{field, params, results}}, nil)
+	m.Imports[0].Module = module
+	m.Types[1] = wasmtest.Type{}
+	return m.Bytes()
+}
+
+func TestImportModules(t *testing.T) {
+	const (
+		i32 = wasmtest.I32
+		i64 = wasmtest.I64
+	)
+
+	wasi := vm.NewHostModule("wasi")
+	wasi.Register("fd_write", "(iiii)i", &vm.TCAbort{})
+	env := vm.NewEnvTable(append(vm.BaseModules(), ChainModule)...)
+	env.RegisterModule("wasi_snapshot_preview1", wasi)
+
+	tests := []struct {
+		code []byte
+		err  error
+	}{
+		{importCode("env", "TC_Prints", []byte{i32}, nil), nil},
+		{importCode("wasi_snapshot_preview1", "fd_write", []byte{i32, i32, i32, i32}, []byte{i32}), nil},
+		{importCode("wasi_unstable", "fd_write", []byte{i32, i32, i32, i32}, []byte{i32}), vm.ErrImportModule},
+		{importCode("wasi_snapshot_preview1", "fd_read", []byte{i32, i32, i32, i32}, []byte{i32}), vm.ErrImportFunc},
+		{importCode("env", "TC_NotExist", nil, nil), vm.ErrImportFunc},
+		{importCode("wasi_snapshot_preview1", "fd_write", []byte{i32, i64}, []byte{i32}), vm.ErrImportSignature},
+		{importCode("env", "TC_Transfer", []byte{i32}, nil), vm.ErrImportSignature},
+		{importCode("env", "TC_GetMsgGas", nil, []byte{i32}), vm.ErrImportSignature},
+		{importCode("env", "TC_CallContractWithGas", []byte{i32, i32, i32, i64}, []byte{i32}), nil},
+	}
+	for i, tt := range tests {
+		contract := vm.NewContract(cAddr.Bytes(), cAddr.Bytes(), big.NewInt(0), 0)
+		eng := vm.NewEngine(contract, 100000, cState, log.Test(), vm.NewAppCache(0, 0), nil)
+		eng.SetEnvTable(env)
+
+		_, err := eng.NewApp(cAddr.String(), tt.code, false)
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("#%d: new app: wanted(%v), got(%v)", i, tt.err, err)
+		}
+		if err != nil {
+			t.Logf("#%d: %v", i, err)
+		}
+	}
+
+	if env.GetFuncByName("wasi_snapshot_preview1.fd_write") == nil {
+		t.Fatalf("wasi_snapshot_preview1.fd_write not found")
+	}
+}
+
+// tc2StorageCode returns a contract storing val under key with
+// tc2_storage_set, and returning the result of reading it back with
+// tc2_storage_get into a buffer at tc2Out.
+func tc2StorageCode(key, val []byte) []byte {
+	i32 := wasmtest.I32
+	data := contractData(append(append([]byte{}, key...), val...))
+	var body []byte
+	for _, arg := range []int{contractDataBase, len(key), contractDataBase + len(key), len(val)} {
+		body = append(body, wasmtest.I32Const(int32(arg))...)
+	}
+	body = append(body, 0x10, 0)
+	for _, arg := range []int{contractDataBase, len(key), tc2Out, 8} {
+		body = append(body, wasmtest.I32Const(int32(arg))...)
+	}
+	body = append(body, 0x10, 1)
+	return contractCode([]hostImport{
+		{"tc2_storage_set", []byte{i32, i32, i32, i32}, nil},
+		{"tc2_storage_get", []byte{i32, i32, i32, i32}, []byte{i32}},
+	}, data, body...)
+}
+
+// tc2Out is the buffer of tc2StorageCode, it lives in the stack as the data
+// segment is read-only.
+const tc2Out = 1024
+
+func TestTC2Storage(t *testing.T) {
+	key := []byte{'k', 0, 'y'}
+	val := []byte{0, 1, 0, 2}
+	addr := types.BytesToAddress([]byte{135})
+	cState.SetCode(addr, tc2StorageCode(key, val))
+
+	ctx := Context{
+		Time:        new(big.Int).SetUint64(ctxTime),
+		BlockNumber: big.NewInt(3456),
+	}
+	contract := vm.NewContract(cAddr.Bytes(), addr.Bytes(), big.NewInt(0), 0)
+	contract.Input = []byte("a|a")
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+	Inject(eng, &ctx)
+
+	app, err := eng.NewApp(addr.String(), nil, false)
+	if err != nil {
+		t.Fatalf("new app fail: %v", err)
+	}
+	ret, err := eng.Run(app, contract.Input)
+	if err != nil {
+		t.Fatalf("run fail: %v", err)
+	}
+	if ret != uint64(len(val)) {
+		t.Fatalf("tc2_storage_get: wanted(%d), got(%d)", len(val), ret)
+	}
+	if got := cState.GetState(addr, types.Keccak256Hash(key)); !bytes.Equal(got, val) {
+		t.Fatalf("state: wanted(%x), got(%x)", val, got)
+	}
+	mem := app.VM.VMemory().Memory
+	if got := mem[tc2Out : tc2Out+len(val)]; !bytes.Equal(got, val) {
+		t.Fatalf("buffer: wanted(%x), got(%x)", val, got)
+	}
+}
+
+func TestABI(t *testing.T) {
+	desc := `{"actions": [
+		{"name": "balance", "inputs": [{"name": "addr", "type": "address"}], "output": "bigint"},
+		{"name": "set", "inputs": [
+			{"name": "n", "type": "int"},
+			{"name": "m", "type": "int64"},
+			{"name": "s", "type": "string"},
+			{"name": "v", "type": "bigint"},
+			{"name": "f", "type": "double"}
+		]}
+	]}`
+	abi, err := vm.ParseABI([]byte(desc))
+	if err != nil {
+		t.Fatalf("parse abi fail: %v", err)
+	}
+
+	input, err := abi.Encode("set", 7, int64(-1)<<40, "a\"b", big.NewInt(1000), 0.5)
+	if err != nil {
+		t.Fatalf("encode fail: %v", err)
+	}
+	action, args, err := abi.Decode(input)
+	if err != nil {
+		t.Fatalf("decode %s fail: %v", input, err)
+	}
+	if action != "set" || args[0] != int32(7) || args[1] != int64(-1)<<40 || args[2] != "a\"b" ||
+		args[3].(*big.Int).Cmp(big.NewInt(1000)) != 0 || args[4] != 0.5 {
+		t.Fatalf("decode %s: got %s %v", input, action, args)
+	}
+
+	for i, tt := range []struct {
+		input string
+		err   error
+	}{
+		{`balance|{"addr":"0x0000000000000000000000000000000000000001"}`, nil},
+		{`balance|{"addr":"0x01"}`, vm.ErrABIArgs},
+		{`balance|{}`, vm.ErrABIArgs},
+		{`balance|{"addr":"0x0000000000000000000000000000000000000001","x":1}`, vm.ErrABIArgs},
+		{`transfer|{}`, vm.ErrABIAction},
+		{`set|{"n":4294967296,"m":1,"s":"","v":"1","f":1}`, vm.ErrABIArgs},
+	} {
+		if _, _, err := abi.Decode([]byte(tt.input)); !errors.Is(err, tt.err) {
+			t.Fatalf("#%d: decode %s: wanted(%v), got(%v)", i, tt.input, tt.err, err)
+		}
+	}
+	if _, err := abi.Encode("balance", "0x01"); !errors.Is(err, vm.ErrABIArgs) {
+		t.Fatalf("encode bad address: %v", err)
+	}
+	if _, err := vm.ParseABI([]byte(`{"actions":[{"name":"a","inputs":[{"name":"x","type":"uint"}]}]}`)); !errors.Is(err, vm.ErrInvalidABI) {
+		t.Fatalf("parse unknown type: %v", err)
+	}
+
+	v, err := abi.DecodeOutput("balance", []byte("10000"))
+	if err != nil || v.(*big.Int).Int64() != 10000 {
+		t.Fatalf("decode output: %v %v", v, err)
+	}
+
+	code, err := ioutil.ReadFile("../../../testdata/getbalance.wasm")
+	if err != nil {
+		t.Logf("read wasm code fail: %v", err)
+		return
+	}
+	addr := types.BytesToAddress([]byte{136})
+	cState.SetCode(addr, code)
+	ctx := Context{
+		Time:        new(big.Int).SetUint64(ctxTime),
+		BlockNumber: big.NewInt(3456),
+	}
+	input, err = abi.Encode("balance", cAddr)
+	if err != nil {
+		t.Fatalf("encode fail: %v", err)
+	}
+	for i, in := range [][]byte{[]byte("a|a"), input} {
+		contract := vm.NewContract(cAddr.Bytes(), addr.Bytes(), big.NewInt(0), 0)
+		eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+		Inject(eng, &ctx)
+		app, err := eng.NewApp(addr.String(), nil, false)
+		if err != nil {
+			t.Fatalf("#%d: new app fail: %v", i, err)
+		}
+		app.ABI = abi
+		_, err = eng.Run(app, in)
+		if i == 0 && !errors.Is(err, vm.ErrABIAction) {
+			t.Fatalf("#%d: run %s: wanted(%v), got(%v)", i, in, vm.ErrABIAction, err)
+		}
+		if i == 1 && err != nil {
+			t.Fatalf("#%d: run %s fail: %v", i, in, err)
+		}
+	}
+}
+
+// withABI returns code with desc in its vm.ABISectionName custom section.
+func withABI(code []byte, desc string) []byte {
+	return wasmtest.AppendCustom(code, vm.ABISectionName, []byte(desc))
+}
+
+func TestABISection(t *testing.T) {
+	const desc = `{"actions":[{"name":"store","inputs":[]}],
+		"events":[{"name":"Stored","inputs":[{"name":"n","type":"int"}]}]}`
+	ctx := testContext()
+
+	tests := []struct {
+		code []byte
+		err  error
+	}{
+		{withABI(tc2StorageCode([]byte("k"), []byte("v")), desc), nil},
+		{withABI(tc2StorageCode([]byte("k"), []byte("v")), `{"actions":[{"name":"a|b"}]}`), vm.ErrInvalidABI},
+		{withABI(importCode("env", "TC_Prints", []byte{wasmtest.I32}, nil), desc), vm.ErrABIExport},
+	}
+	for i, tt := range tests {
+		w := NewWASM(ctx, cState, nil)
+		_, addr, _, err := w.Create(vm.AccountRef(cAddr), tt.code, 1000000, big.NewInt(0))
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("#%d: create: wanted(%v), got(%v)", i, tt.err, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		contract := vm.NewContract(cAddr.Bytes(), addr.Bytes(), big.NewInt(0), 0)
+		eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+		Inject(eng, &Context{Time: ctx.Time, BlockNumber: ctx.BlockNumber})
+		app, err := eng.NewApp(addr.String(), nil, false)
+		if err != nil {
+			t.Fatalf("#%d: new app fail: %v", i, err)
+		}
+		if app.ABI == nil {
+			t.Fatalf("#%d: abi not read", i)
+		}
+		if _, ok := app.ABI.Action("store"); !ok {
+			t.Fatalf("#%d: action store not found", i)
+		}
+		topic := types.Keccak256Hash([]byte("Stored"))
+		event, args, err := app.ABI.DecodeEvent([]types.Hash{topic}, []byte(`{"n":3}`))
+		if err != nil || event.Name != "Stored" || args[0] != int32(3) {
+			t.Fatalf("#%d: decode event: %v %v %v", i, event, args, err)
+		}
+
+		if _, _, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("a|a"), 100000, big.NewInt(0)); !errors.Is(err, vm.ErrABIAction) {
+			t.Fatalf("#%d: call undeclared action: %v", i, err)
+		}
+		if _, _, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("store|{}"), 100000, big.NewInt(0)); err != nil {
+			t.Fatalf("#%d: call fail: %v", i, err)
+		}
+	}
+}
+
+// exportCode returns a contract without APPEntry, exporting
+// add(int32, int32) int32 and neg(int64) int64.
+func exportCode(abi string) []byte {
+	i32, i64 := wasmtest.I32, wasmtest.I64
+	m := wasmtest.Module{
+		Types: []wasmtest.Type{
+			{Params: []byte{i32, i32}, Results: []byte{i32}},
+			{Params: []byte{i64}, Results: []byte{i64}},
+		},
+		Funcs: []wasmtest.Func{
+			{Type: 0, Code: []byte{0x20, 0, 0x20, 1, 0x6a}},
+			{Type: 1, Code: []byte{0x42, 0, 0x20, 0, 0x7d}},
+		},
+		Memory:  &wasmtest.Limits{Min: 1},
+		Globals: []wasmtest.Global{{Type: i32, Init: wasmtest.I32Const(contractHeap)}},
+		Exports: []wasmtest.Export{
+			{Name: "add", Kind: wasmtest.KindFunc, Index: 0},
+			{Name: "neg", Kind: wasmtest.KindFunc, Index: 1},
+			{Name: "__heap_base", Kind: wasmtest.KindGlobal, Index: 0},
+		},
+		Customs: []wasmtest.Custom{{Name: vm.ABISectionName, Payload: []byte(abi)}},
+	}
+	return m.Bytes()
+}
+
+func TestExportDispatch(t *testing.T) {
+	const desc = `{"dispatch":"export","actions":[
+		{"name":"add","inputs":[{"name":"a","type":"int"},{"name":"b","type":"int"}],"output":"int"},
+		{"name":"neg","inputs":[{"name":"x","type":"int64"}],"output":"int64"}]}`
+	ctx := testContext()
+	w := NewWASM(ctx, cState, nil)
+
+	bad := strings.Replace(desc, `"type":"int64"`, `"type":"int"`, 1)
+	if _, _, _, err := w.Create(vm.AccountRef(cAddr), exportCode(bad), 1000000, big.NewInt(0)); !errors.Is(err, vm.ErrABIExport) {
+		t.Fatalf("create with mismatched abi: %v", err)
+	}
+	_, addr, _, err := w.Create(vm.AccountRef(cAddr), exportCode(desc), 1000000, big.NewInt(0))
+	if err != nil {
+		t.Fatalf("create fail: %v", err)
+	}
+
+	for i, tt := range []struct {
+		input, ret string
+		err        error
+	}{
+		{`add|{"a":2,"b":-5}`, "-3", nil},
+		{`neg|{"x":7}`, "-7", nil},
+		{`add|{"a":2}`, "", vm.ErrABIArgs},
+		{`sub|{}`, "", vm.ErrABIAction},
+	} {
+		ret, _, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte(tt.input), 100000, big.NewInt(0))
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("#%d: call %s: wanted(%v), got(%v)", i, tt.input, tt.err, err)
+		}
+		if string(ret) != tt.ret {
+			t.Fatalf("#%d: call %s: wanted(%s), got(%s)", i, tt.input, tt.ret, ret)
+		}
+	}
+
+	// the native code calls the exported functions as well
+	dir, err := ioutil.TempDir("", "tcvm-export")
+	if err != nil {
+		t.Fatalf("create temp dir fail: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for i, input := range []string{`add|{"a":2,"b":-5}`, `neg|{"x":7}`} {
+		if _, _, err := checkParity(ctx, cState, cAddr, addr, []byte(input), 100000, dir); err != nil {
+			t.Fatalf("#%d: %s: %v", i, input, err)
+		}
+	}
+}
+
+// returnDataCode returns a contract passing data to TC_SetReturnData and
+// returning a pointer to it.
+func returnDataCode(data []byte) []byte {
+	i32 := wasmtest.I32
+	body := append(wasmtest.I32Const(contractDataBase), wasmtest.I32Const(int32(len(data)))...)
+	body = append(append(body, 0x10, 0), wasmtest.I32Const(contractDataBase)...)
+	return contractCode([]hostImport{
+		{"TC_SetReturnData", []byte{i32, i32}, nil},
+	}, contractData(data), body...)
+}
+
+func TestSetReturnData(t *testing.T) {
+	data := []byte{'a', 0, 'b', 0}
+	addr := types.BytesToAddress([]byte{137})
+	cState.SetCode(addr, returnDataCode(data))
+
+	ctx := testContext()
+	w := NewWASM(ctx, cState, nil)
+	ret, _, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("a|a"), 100000, big.NewInt(0))
+	if err != nil {
+		t.Fatalf("call fail: %v", err)
+	}
+	if !bytes.Equal(ret, data) {
+		t.Fatalf("return data: wanted(%x), got(%x)", data, ret)
+	}
+}
+
+// revertCode returns a contract reverting with msg.
+func revertCode(msg string) []byte {
+	var data contractData
+	body := append(append(data.add(msg), 0x10, 0), wasmtest.I32Const(0)...)
+	return contractCode([]hostImport{
+		{"TC_RevertWithMsg", []byte{wasmtest.I32}, nil},
+	}, data, body...)
+}
+
+// callCode returns a contract calling action a of callee with call, one of
+// TC_CallContract and TC_TryCallContract, and returning the result of the
+// call.
+func callCode(call string, callee types.Address) []byte {
+	i32 := wasmtest.I32
+	var data contractData
+	body := append(data.add(callee.String()), data.add("a")...)
+	body = append(append(body, data.add("")...), 0x10, 0, 0x1a)
+	body = append(append(body, wasmtest.I32Const(tc2Out)...), wasmtest.I32Const(0)...)
+	body = append(append(body, 0x10, 1, 0x10, 2), wasmtest.I32Const(tc2Out)...)
+	body = append(append(body, 0x10, 1, 0x10, 3), wasmtest.I32Const(0)...)
+	return contractCode([]hostImport{
+		{call, []byte{i32, i32, i32}, []byte{i32}},
+		{"TC_ReturnDataSize", nil, []byte{i32}},
+		{"TC_ReturnDataCopy", []byte{i32, i32, i32}, nil},
+		{"TC_SetReturnData", []byte{i32, i32}, nil},
+	}, data, body...)
+}
+
+func TestRevertData(t *testing.T) {
+	msg := "not enough"
+	callee := types.BytesToAddress([]byte{138})
+	caller := types.BytesToAddress([]byte{139})
+	cState.SetCode(callee, revertCode(msg))
+	cState.SetCode(caller, callCode("TC_TryCallContract", callee))
+
+	ctx := testContext()
+	w := NewWASM(ctx, cState, nil)
+	ret, _, err := w.Call(vm.AccountRef(cAddr), callee, types.EmptyAddress, []byte("a|a"), 100000, big.NewInt(0))
+	if !errors.Is(err, vm.ErrExecutionReverted) {
+		t.Fatalf("call: wanted(%v), got(%v)", vm.ErrExecutionReverted, err)
+	}
+	if string(ret) != msg {
+		t.Fatalf("revert data: wanted(%s), got(%s)", msg, ret)
+	}
+
+	ret, _, err = w.Call(vm.AccountRef(cAddr), caller, types.EmptyAddress, []byte("a|a"), 1000000, big.NewInt(0))
+	if err != nil {
+		t.Fatalf("try call fail: %v", err)
+	}
+	if string(ret) != msg {
+		t.Fatalf("return data: wanted(%s), got(%s)", msg, ret)
+	}
+
+	dir, err := ioutil.TempDir("", "tcvm-revert")
+	if err != nil {
+		t.Fatalf("create temp dir fail: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	native, err := runParity(ctx, cState.Copy(), cAddr, callee, []byte("a|a"), 100000, dir)
+	if err != nil {
+		t.Fatalf("native run fail: %v", err)
+	}
+	if !errors.Is(native.Err, vm.ErrExecutionReverted) || string(native.Ret) != msg {
+		t.Fatalf("native: wanted(%v, %s), got(%v, %s)", vm.ErrExecutionReverted, msg, native.Err, native.Ret)
+	}
+}
+
+func TestVMError(t *testing.T) {
+	callee := types.BytesToAddress([]byte{140})
+	caller := types.BytesToAddress([]byte{141})
+	cState.SetCode(callee, revertCode("no"))
+	cState.SetCode(caller, callCode("TC_CallContract", callee))
+
+	ctx := testContext()
+	w := NewWASM(ctx, cState, nil)
+	_, _, err := w.Call(vm.AccountRef(cAddr), caller, types.EmptyAddress, []byte("a|a"), 1000000, big.NewInt(0))
+	if !errors.Is(err, vm.ErrExecutionReverted) {
+		t.Fatalf("call: wanted(%v), got(%v)", vm.ErrExecutionReverted, err)
+	}
+	var e *vm.Error
+	if !errors.As(err, &e) {
+		t.Fatalf("call: wanted *vm.Error, got(%T)", err)
+	}
+	if e.Class != vm.ClassRevert || e.Address != callee.String() || e.Depth != 1 || e.Func != "TC_RevertWithMsg" {
+		t.Fatalf("call: wanted revert of %s at depth 1 in TC_RevertWithMsg, got(%s %s %d %s)", callee.String(), e.Class, e.Address, e.Depth, e.Func)
+	}
+	bt := []vm.StackFrame{{App: callee.String(), Func: 1}, {App: caller.String(), Func: 4}}
+	if !reflect.DeepEqual(e.Backtrace, bt) {
+		t.Fatalf("backtrace: wanted(%v), got(%v)", bt, e.Backtrace)
+	}
+
+	// the native code reports the function running as well
+	dir, err := ioutil.TempDir("", "tcvm-error")
+	if err != nil {
+		t.Fatalf("create temp dir fail: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	native, err := runParity(ctx, cState.Copy(), cAddr, callee, []byte("a|a"), 100000, dir)
+	if err != nil {
+		t.Fatalf("native run fail: %v", err)
+	}
+	if !errors.As(native.Err, &e) || !reflect.DeepEqual(e.Backtrace, bt[:1]) {
+		t.Fatalf("native backtrace: wanted(%v), got(%v)", bt[:1], native.Err)
+	}
+
+	_, _, err = w.Call(vm.AccountRef(cAddr), caller, types.EmptyAddress, []byte("a|a"), 10, big.NewInt(0))
+	if !errors.Is(err, vm.ErrOutOfGas) || !errors.As(err, &e) || e.Class != vm.ClassGas {
+		t.Fatalf("call: wanted(%v), got(%v)", vm.ErrOutOfGas, err)
+	}
+}
+
+// trapModule returns a contract whose entry runs body. The entry, of type 0,
+// is the only element of its table, type 1 is () i32.
+func trapModule(body ...byte) *wasmtest.Module {
+	m := contractModule(nil, nil, body...)
+	m.Types = append(m.Types, wasmtest.Type{Results: []byte{wasmtest.I32}})
+	m.Table = &wasmtest.Limits{Min: 1}
+	m.Elems = []wasmtest.Elem{{Offset: 0, Funcs: []uint32{0}}}
+	return m
+}
+
+// trapCode returns the encoding of trapModule.
+func trapCode(body ...byte) []byte {
+	return trapModule(body...).Bytes()
+}
+
+func TestTrapStatus(t *testing.T) {
+	tests := []struct {
+		body   []byte
+		err    error
+		status vm.Status
+	}{
+		{[]byte{0x00}, vm.ErrTrapUnreachable, vm.StatusUnreachable},
+		{append(append(wasmtest.I32Const(1), wasmtest.I32Const(0)...), 0x6d), vm.ErrTrapDivByZero, vm.StatusDivByZero},
+		{append(wasmtest.I32Const(-1), 0x28, 2, 0), vm.ErrTrapMemoryOutOfBounds, vm.StatusMemoryOutOfBounds},
+		{append(wasmtest.I32Const(0), 0x11, 1, 0), vm.ErrTrapIndirectCallType, vm.StatusIndirectCallType},
+		{append(append(append(wasmtest.I32Const(0), wasmtest.I32Const(0)...), wasmtest.I32Const(1)...), 0x11, 0, 0), vm.ErrTrapTableOutOfBounds, vm.StatusTableOutOfBounds},
+		{[]byte{0x20, 0, 0x20, 1, 0x10, 0}, vm.ErrTrapStackOverflow, vm.StatusStackOverflow},
+		{wasmtest.I32Const(0), nil, vm.StatusOK},
+	}
+
+	ctx := testContext()
+	dir, err := ioutil.TempDir("", "tcvm-trap")
+	if err != nil {
+		t.Fatalf("create temp dir fail: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for i, tt := range tests {
+		addr := types.BytesToAddress([]byte{142, byte(i)})
+		cState.SetCode(addr, trapCode(tt.body...))
+		w := NewWASM(ctx, cState, nil)
+		_, _, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("a|a"), 100000, big.NewInt(0))
+		if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+			t.Fatalf("case %d: wanted err(%v), got(%v)", i, tt.err, err)
+		}
+		if w.Status() != tt.status || vm.StatusOf(err) != tt.status {
+			t.Fatalf("case %d: wanted status(%v), got(%v)", i, tt.status, w.Status())
+		}
+
+		// the native code does not check the bounds of memory accesses
+		if tt.err == vm.ErrTrapMemoryOutOfBounds {
+			continue
+		}
+		native, err := runParity(ctx, cState.Copy(), cAddr, addr, []byte("a|a"), 100000, dir)
+		if err != nil {
+			t.Fatalf("case %d: native run fail: %v", i, err)
+		}
+		if !errors.Is(native.Err, tt.err) || (tt.err == nil && native.Err != nil) {
+			t.Fatalf("case %d: native: wanted err(%v), got(%v)", i, tt.err, native.Err)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	ctx := testContext()
+	addr := types.BytesToAddress([]byte{143})
+	cState.SetCode(addr, trapCode(wasmtest.I32Const(0)...))
+	w := NewWASM(ctx, cState, nil)
+	if _, _, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("a|a"), 100000, big.NewInt(0)); err != nil {
+		t.Fatalf("call fail: %v", err)
+	}
+
+	// the contract is cached, it must be checked again with other limits
+	limits := vm.DefaultLimits
+	limits.Functions = 0
+	w.SetLimits(&limits)
+	if _, _, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("a|a"), 100000, big.NewInt(0)); !errors.Is(err, vm.ErrLimitExceeded) {
+		t.Fatalf("functions: wanted(%v), got(%v)", vm.ErrLimitExceeded, err)
+	}
+
+	m := trapModule(wasmtest.I32Const(0)...)
+	m.Data = []wasmtest.Data{{Offset: 0x7ffffff0, Bytes: []byte{1}}}
+	cState.SetCode(addr, m.Bytes())
+	w.SetLimits(nil)
+	if _, _, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("a|a"), 100000, big.NewInt(0)); !errors.Is(err, vm.ErrLimitExceeded) {
+		t.Fatalf("data: wanted(%v), got(%v)", vm.ErrLimitExceeded, err)
+	}
+
+	callee := types.BytesToAddress([]byte{144})
+	caller := types.BytesToAddress([]byte{145})
+	cState.SetCode(callee, trapCode(wasmtest.I32Const(0)...))
+	cState.SetCode(caller, callCode("TC_CallContract", callee))
+	limits = vm.DefaultLimits
+	limits.FrameDepth = 0
+	w.SetLimits(&limits)
+	if _, _, err := w.Call(vm.AccountRef(cAddr), caller, types.EmptyAddress, []byte("a|a"), 1000000, big.NewInt(0)); !errors.Is(err, vm.ErrOverFrame) {
+		t.Fatalf("frames: wanted(%v), got(%v)", vm.ErrOverFrame, err)
+	}
+
+	limits = vm.DefaultLimits
+	limits.FrameDepth = -1
+	w.SetLimits(&limits)
+	if _, _, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("a|a"), 100000, big.NewInt(0)); !errors.Is(err, vm.ErrInvalidLimits) {
+		t.Fatalf("negative frames: wanted(%v), got(%v)", vm.ErrInvalidLimits, err)
+	}
+	for i, set := range []func(*vm.Limits){
+		func(l *vm.Limits) { l.MemoryPages = 0 },
+		func(l *vm.Limits) { l.MemoryPages = 65537 },
+		func(l *vm.Limits) { l.TableEntries = 10000001 },
+	} {
+		limits = vm.DefaultLimits
+		set(&limits)
+		w.SetLimits(&limits)
+		if _, _, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("a|a"), 100000, big.NewInt(0)); !errors.Is(err, vm.ErrInvalidLimits) {
+			t.Fatalf("#%d: out of range: wanted(%v), got(%v)", i, vm.ErrInvalidLimits, err)
+		}
+	}
+
+	// grow_memory fails past the memory pages, the contract traps if it does
+	// not: i32.const 2; grow_memory; i32.const -1; i32.ne; if; unreachable; end
+	grow := append(append(wasmtest.I32Const(2), 0x40, 0), wasmtest.I32Const(-1)...)
+	grow = append(append(grow, 0x47, 0x04, 0x40, 0x00, 0x0b), wasmtest.I32Const(0)...)
+	cState.SetCode(addr, trapCode(grow...))
+	limits = vm.DefaultLimits
+	limits.MemoryPages = 1
+	w.SetLimits(&limits)
+	if _, _, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("a|a"), 100000, big.NewInt(0)); err != nil {
+		t.Fatalf("memory pages: %v", err)
+	}
+	w.SetLimits(nil)
+	if _, _, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("a|a"), 100000, big.NewInt(0)); !errors.Is(err, vm.ErrTrapUnreachable) {
+		t.Fatalf("default memory pages: wanted(%v), got(%v)", vm.ErrTrapUnreachable, err)
+	}
+}
+
+func TestDeterminism(t *testing.T) {
+	ctx := testContext()
+	// f32.const 1; drop; i32.const 0
+	code := trapCode(append([]byte{0x43, 0, 0, 0x80, 0x3f, 0x1a}, wasmtest.I32Const(0)...)...)
+	w := NewWASM(ctx, cState, nil)
+	w.SetDeterminism(&vm.DeterminismPolicy{})
+	_, _, _, err := w.Create(vm.AccountRef(cAddr), code, 1000000, big.NewInt(0))
+	if !errors.Is(err, vm.ErrNonDeterministic) {
+		t.Fatalf("wanted(%v), got(%v)", vm.ErrNonDeterministic, err)
+	}
+	want := []vm.Violation{
+		{Func: -1, Offset: -1, Msg: "memory without maximum"},
+		{Func: 0, Offset: 0, Msg: "float operator f32.const"},
+	}
+	if got := err.(*vm.DeterminismError).Violations; !reflect.DeepEqual(got, want) {
+		t.Fatalf("violations: wanted(%v), got(%v)", want, got)
+	}
+
+	// the interpreter forbids floats when the contract runs anyway
+	if err := vm.CheckDeterminism(code, vm.DefaultEnvTable(), vm.DeterminismPolicy{AllowFloats: true, AllowUnboundedMemory: true}); err != nil {
+		t.Fatalf("allowed: %v", err)
+	}
+
+	if err := vm.CheckDeterminism(importCode("wasi", "fd_write", nil, nil), vm.DefaultEnvTable(), vm.DeterminismPolicy{AllowUnboundedMemory: true}); !errors.Is(err, vm.ErrNonDeterministic) {
+		t.Fatalf("import: wanted(%v), got(%v)", vm.ErrNonDeterministic, err)
+	}
+}
+
+func TestGasMetering(t *testing.T) {
+	ctx := testContext()
+	// counts the first parameter down from 5 in a loop
+	loop := append(wasmtest.I32Const(5), 0x21, 0, 0x03, 0x40, 0x20, 0)
+	loop = append(append(loop, wasmtest.I32Const(1)...), 0x6b, 0x22, 0, 0x0d, 0, 0x0b)
+	addr := types.BytesToAddress([]byte{146})
+	cState.SetCode(addr, trapCode(append(loop, wasmtest.I32Const(0)...)...))
+	callee := types.BytesToAddress([]byte{147})
+	caller := types.BytesToAddress([]byte{148})
+	cState.SetCode(callee, trapCode(wasmtest.I32Const(0)...))
+	cState.SetCode(caller, callCode("TC_CallContract", callee))
+
+	const gas = 1000000
+	gasUsed := func(schedule *vm.GasSchedule, to types.Address) uint64 {
+		w := NewWASM(ctx, cState, nil)
+		w.SetGasSchedule(schedule)
+		_, left, err := w.Call(vm.AccountRef(cAddr), to, types.EmptyAddress, []byte("a|a"), gas, big.NewInt(0))
+		if err != nil {
+			t.Fatalf("call fail: %v", err)
+		}
+		return gas - left
+	}
+
+	// the default schedule charges what the interpreter charges, but for the
+	// nop it runs at the end of each function
+	for _, tt := range []struct {
+		to    types.Address
+		calls uint64
+	}{{addr, 1}, {caller, 2}} {
+		want := gasUsed(nil, tt.to) - tt.calls*vm.GasFastestStep
+		if got := gasUsed(&vm.DefaultGasSchedule, tt.to); got != want {
+			t.Fatalf("%s: wanted(%d), got(%d)", tt.to.String(), want, got)
+		}
+	}
+
+	schedule := vm.DefaultGasSchedule
+	schedule.Ops[0x6b] += 100
+	if want, got := gasUsed(&vm.DefaultGasSchedule, addr)+5*100, gasUsed(&schedule, addr); got != want {
+		t.Fatalf("i32.sub: wanted(%d), got(%d)", want, got)
+	}
+
+	w := NewWASM(ctx, cState, nil)
+	w.SetGasSchedule(&schedule)
+	if _, _, err := w.Call(vm.AccountRef(cAddr), addr, types.EmptyAddress, []byte("a|a"), 300, big.NewInt(0)); !errors.Is(err, vm.ErrOutOfGas) {
+		t.Fatalf("out of gas: wanted(%v), got(%v)", vm.ErrOutOfGas, err)
+	}
+
+	// grow_memory is charged for the pages it is asked for:
+	// i32.const 2; grow_memory; drop; i32.const 0
+	grow := types.BytesToAddress([]byte{149})
+	cState.SetCode(grow, trapCode(append(append(wasmtest.I32Const(2), 0x40, 0, 0x1a), wasmtest.I32Const(0)...)...))
+	want := gasUsed(nil, grow) - vm.GasFastestStep + 2*vm.MemPageGas
+	if got := gasUsed(&vm.DefaultGasSchedule, grow); got != want {
+		t.Fatalf("grow_memory: wanted(%d), got(%d)", want, got)
+	}
+	schedule = vm.DefaultGasSchedule
+	schedule.MemoryPage = 0
+	if want, got := gasUsed(nil, grow)-vm.GasFastestStep, gasUsed(&schedule, grow); got != want {
+		t.Fatalf("grow_memory without page cost: wanted(%d), got(%d)", want, got)
+	}
+
+	// only engines with a gas schedule expose the gas function
+	code := importCode("env", vm.GasFuncName, []byte{wasmtest.I64}, nil)
+	gasAddr := types.BytesToAddress([]byte{150})
+	cState.SetCode(gasAddr, code)
+	for _, schedule := range []*vm.GasSchedule{nil, &vm.DefaultGasSchedule} {
+		contract := vm.NewContract(cAddr.Bytes(), gasAddr.Bytes(), big.NewInt(0), 0)
+		eng := vm.NewEngine(contract, gas, cState, log.Test(), nil, nil)
+		Inject(eng, &ctx)
+		eng.SetGasSchedule(schedule)
+		_, err := eng.NewApp(gasAddr.String(), nil, false)
+		if schedule == nil && !errors.Is(err, vm.ErrImportFunc) {
+			t.Fatalf("gas import: wanted(%v), got(%v)", vm.ErrImportFunc, err)
+		} else if schedule != nil && err != nil {
+			t.Fatalf("gas import with a schedule: %v", err)
+		}
+	}
+	if err := vm.CheckDeterminism(code, vm.DefaultEnvTable(), vm.DeterminismPolicy{AllowUnboundedMemory: true}); !errors.Is(err, vm.ErrNonDeterministic) {
+		t.Fatalf("gas import determinism: wanted(%v), got(%v)", vm.ErrNonDeterministic, err)
+	}
+
+	// functions registered after a metered contract is loaded are imported
+	env := vm.NewEnvTable(append(vm.BaseModules(), ChainModule)...)
+	for i, code := range [][]byte{code, importCode("env", "TC_Later", nil, nil)} {
+		if i == 1 {
+			env.RegisterFunc("TC_Later", "()", &vm.TCAbort{})
+		}
+		contract := vm.NewContract(cAddr.Bytes(), gasAddr.Bytes(), big.NewInt(0), 0)
+		eng := vm.NewEngine(contract, gas, cState, log.Test(), vm.NewAppCache(0, 0), nil)
+		eng.SetEnvTable(env)
+		eng.SetGasSchedule(&vm.DefaultGasSchedule)
+		if _, err := eng.NewApp(gasAddr.String(), code, false); err != nil {
+			t.Fatalf("#%d: new app fail: %v", i, err)
+		}
+	}
+
+	// the native code of a metered contract charges what the interpreter does
+	dir, err := ioutil.TempDir("", "tcvm-metering")
+	if err != nil {
+		t.Fatalf("create temp dir fail: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	var used [2]uint64
+	for i, native := range []bool{false, true} {
+		contract := vm.NewContract(cAddr.Bytes(), addr.Bytes(), big.NewInt(0), gas)
+		eng := vm.NewEngine(contract, gas, cState, log.Test(), vm.NewAppCache(0, 0), nil)
+		Inject(eng, &ctx)
+		eng.SetGasSchedule(&vm.DefaultGasSchedule)
+		app, err := eng.NewApp(addr.String(), nil, false)
+		if err != nil {
+			t.Fatalf("new app fail: %v", err)
+		}
+		if native {
+			n, err := vm.CompileNative(app, dir)
+			if err != nil {
+				t.Fatalf("compile native fail: %v", err)
+			}
+			app.SetNative(n)
+			n.Close()
+		}
+		if _, err := eng.Run(app, []byte("a|a")); err != nil {
+			t.Fatalf("run fail: %v", err)
+		}
+		if native && app.IsPreRun {
+			t.Fatalf("native code not run")
+		}
+		used[i] = eng.GasUsed()
+	}
+	if used[0] != used[1] {
+		t.Fatalf("native gas: wanted(%d), got(%d)", used[0], used[1])
+	}
+}
+
+func TestReentrancy(t *testing.T) {
+	self := types.BytesToAddress([]byte{165})
+	cycleA := types.BytesToAddress([]byte{166})
+	cycleB := types.BytesToAddress([]byte{167})
+	staticA := types.BytesToAddress([]byte{168})
+	staticB := types.BytesToAddress([]byte{169})
+	cState.SetCode(self, callCode("TC_CallContract", self))
+	cState.SetCode(cycleA, callCode("TC_CallContract", cycleB))
+	cState.SetCode(cycleB, callCode("TC_CallContract", cycleA))
+	cState.SetCode(staticA, callCode("TC_StaticCallContract", staticB))
+	cState.SetCode(staticB, callCode("TC_CallContract", staticA))
+
+	// the contracts call each other forever, unless the policy stops them
+	// before the frame stack is full
+	tests := []struct {
+		policy              vm.ReentrancyPolicy
+		self, cycle, static error
+	}{
+		{vm.ReentrancyForbidSelf, vm.ErrReentrancy, vm.ErrOverFrame, vm.ErrOverFrame},
+		{vm.ReentrancyForbid, vm.ErrReentrancy, vm.ErrReentrancy, vm.ErrReentrancy},
+		{vm.ReentrancyAllow, vm.ErrOverFrame, vm.ErrOverFrame, vm.ErrOverFrame},
+		{vm.ReentrancyReadOnly, vm.ErrReentrancy, vm.ErrReentrancy, vm.ErrOverFrame},
+	}
+	for _, tt := range tests {
+		w := NewWASM(testContext(), cState, nil)
+		w.SetReentrancyPolicy(tt.policy)
+		for _, c := range []struct {
+			addr types.Address
+			err  error
+		}{{self, tt.self}, {cycleA, tt.cycle}, {staticA, tt.static}} {
+			_, _, err := w.Call(vm.AccountRef(cAddr), c.addr, types.EmptyAddress, []byte("a|a"), 10000000, big.NewInt(0))
+			if !errors.Is(err, c.err) {
+				t.Fatalf("policy %d: %s: wanted(%v), got(%v)", tt.policy, c.addr.String(), c.err, err)
+			}
+		}
+	}
+}
+
+func TestNoContext(t *testing.T) {
+	i64 := wasmtest.I64
+	addr := types.BytesToAddress([]byte{170})
+	cState.SetCode(addr, contractCode([]hostImport{{"TC_Now", nil, []byte{i64}}}, nil, append([]byte{0x10, 0, 0x1a}, wasmtest.I32Const(0)...)...))
+
+	contract := vm.NewContract(cAddr.Bytes(), addr.Bytes(), big.NewInt(0), 0)
+	eng := vm.NewEngine(contract, 100000, cState, log.Test(), nil, nil)
+	eng.SetEnvTable(ChainEnvTable())
+	app, err := eng.NewApp(addr.String(), nil, false)
+	if err != nil {
+		t.Fatalf("new app fail: %v", err)
+	}
+	if _, err := eng.Run(app, []byte("a|a")); !errors.Is(err, ErrNoContext) {
+		t.Fatalf("wanted(%v), got(%v)", ErrNoContext, err)
+	}
+}
@@ -504,6 +504,10 @@ func (s *StateDB) Copy() *StateDB {
 		logSize:           s.logSize,
 		preimages:         make(map[types.Hash][]byte),
 		journal:           newJournal(),
+		contractInfos:     make(map[types.Address][]byte, len(s.contractInfos)),
+		thash:             s.thash,
+		bhash:             s.bhash,
+		txIndex:           s.txIndex,
 	}
 	// Copy the dirty states, logs, and preimages
 	for addr := range s.journal.dirties {
@@ -537,6 +541,9 @@ func (s *StateDB) Copy() *StateDB {
 	for hash, preimage := range s.preimages {
 		state.preimages[hash] = preimage
 	}
+	for addr, info := range s.contractInfos {
+		state.contractInfos[addr] = info
+	}
 	return state
 }
 
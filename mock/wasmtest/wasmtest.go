@@ -0,0 +1,254 @@
+// Package wasmtest builds the wasm modules run by the tests.
+package wasmtest
+
+// Value types.
+const (
+	I32 byte = 0x7f
+	I64 byte = 0x7e
+	F32 byte = 0x7d
+	F64 byte = 0x7c
+)
+
+// External kinds of imports and exports.
+const (
+	KindFunc   byte = 0
+	KindTable  byte = 1
+	KindMemory byte = 2
+	KindGlobal byte = 3
+)
+
+// Type is a function signature.
+type Type struct {
+	Params  []byte
+	Results []byte
+}
+
+// Import is a function imported with the signature Types[Type].
+type Import struct {
+	Module string
+	Field  string
+	Type   uint32
+}
+
+// Func is a function with the signature Types[Type]. Locals are the types
+// of its locals past its parameters and Code its body, without the final
+// end.
+type Func struct {
+	Type   uint32
+	Locals []byte
+	Code   []byte
+}
+
+// Limits are the limits of a table or a memory, Max is set when Bounded.
+type Limits struct {
+	Min     uint32
+	Max     uint32
+	Bounded bool
+}
+
+// Global is a global of Type initialized by the constant expression Init,
+// without its end.
+type Global struct {
+	Type    byte
+	Mutable bool
+	Init    []byte
+}
+
+// Export exports the Index of Kind as Name.
+type Export struct {
+	Name  string
+	Kind  byte
+	Index uint32
+}
+
+// Elem places Funcs in the table from Offset.
+type Elem struct {
+	Offset int32
+	Funcs  []uint32
+}
+
+// Data places Bytes in the memory from Offset.
+type Data struct {
+	Offset int32
+	Bytes  []byte
+}
+
+// Custom is a custom section, written after the other sections.
+type Custom struct {
+	Name    string
+	Payload []byte
+}
+
+// Module is a wasm module, the function index space starts with Imports.
+type Module struct {
+	Types   []Type
+	Imports []Import
+	Funcs   []Func
+	Table   *Limits
+	Memory  *Limits
+	Globals []Global
+	Exports []Export
+	Start   *uint32
+	Elems   []Elem
+	Data    []Data
+	Customs []Custom
+}
+
+// Bytes returns the binary encoding of m.
+func (m *Module) Bytes() []byte {
+	b := []byte{0, 'a', 's', 'm', 1, 0, 0, 0}
+	if len(m.Types) != 0 {
+		s := AppendUleb128(nil, uint64(len(m.Types)))
+		for _, t := range m.Types {
+			s = append(AppendUleb128(append(s, 0x60), uint64(len(t.Params))), t.Params...)
+			s = append(AppendUleb128(s, uint64(len(t.Results))), t.Results...)
+		}
+		b = section(b, 1, s)
+	}
+	if len(m.Imports) != 0 {
+		s := AppendUleb128(nil, uint64(len(m.Imports)))
+		for _, imp := range m.Imports {
+			s = appendName(appendName(s, imp.Module), imp.Field)
+			s = AppendUleb128(append(s, KindFunc), uint64(imp.Type))
+		}
+		b = section(b, 2, s)
+	}
+	if len(m.Funcs) != 0 {
+		s := AppendUleb128(nil, uint64(len(m.Funcs)))
+		for _, f := range m.Funcs {
+			s = AppendUleb128(s, uint64(f.Type))
+		}
+		b = section(b, 3, s)
+	}
+	if m.Table != nil {
+		b = section(b, 4, appendLimits([]byte{1, 0x70}, m.Table))
+	}
+	if m.Memory != nil {
+		b = section(b, 5, appendLimits([]byte{1}, m.Memory))
+	}
+	if len(m.Globals) != 0 {
+		s := AppendUleb128(nil, uint64(len(m.Globals)))
+		for _, g := range m.Globals {
+			mutable := byte(0)
+			if g.Mutable {
+				mutable = 1
+			}
+			s = append(append(append(s, g.Type, mutable), g.Init...), 0x0b)
+		}
+		b = section(b, 6, s)
+	}
+	if len(m.Exports) != 0 {
+		s := AppendUleb128(nil, uint64(len(m.Exports)))
+		for _, e := range m.Exports {
+			s = AppendUleb128(append(appendName(s, e.Name), e.Kind), uint64(e.Index))
+		}
+		b = section(b, 7, s)
+	}
+	if m.Start != nil {
+		b = section(b, 8, AppendUleb128(nil, uint64(*m.Start)))
+	}
+	if len(m.Elems) != 0 {
+		s := AppendUleb128(nil, uint64(len(m.Elems)))
+		for _, e := range m.Elems {
+			s = append(append(append(s, 0), I32Const(e.Offset)...), 0x0b)
+			s = AppendUleb128(s, uint64(len(e.Funcs)))
+			for _, f := range e.Funcs {
+				s = AppendUleb128(s, uint64(f))
+			}
+		}
+		b = section(b, 9, s)
+	}
+	if len(m.Funcs) != 0 {
+		s := AppendUleb128(nil, uint64(len(m.Funcs)))
+		for _, f := range m.Funcs {
+			body := appendLocals(nil, f.Locals)
+			body = append(append(body, f.Code...), 0x0b)
+			s = append(AppendUleb128(s, uint64(len(body))), body...)
+		}
+		b = section(b, 10, s)
+	}
+	if len(m.Data) != 0 {
+		s := AppendUleb128(nil, uint64(len(m.Data)))
+		for _, d := range m.Data {
+			s = append(append(append(s, 0), I32Const(d.Offset)...), 0x0b)
+			s = append(AppendUleb128(s, uint64(len(d.Bytes))), d.Bytes...)
+		}
+		b = section(b, 11, s)
+	}
+	for _, c := range m.Customs {
+		b = AppendCustom(b, c.Name, c.Payload)
+	}
+	return b
+}
+
+// AppendCustom appends the custom section name holding payload to the
+// encoded module b.
+func AppendCustom(b []byte, name string, payload []byte) []byte {
+	return section(b, 0, append(appendName(nil, name), payload...))
+}
+
+// I32Const returns the instruction i32.const v.
+func I32Const(v int32) []byte {
+	return AppendSleb128([]byte{0x41}, int64(v))
+}
+
+// I64Const returns the instruction i64.const v.
+func I64Const(v int64) []byte {
+	return AppendSleb128([]byte{0x42}, v)
+}
+
+// AppendUleb128 appends v to b as an unsigned LEB128.
+func AppendUleb128(b []byte, v uint64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// AppendSleb128 appends v to b as a signed LEB128.
+func AppendSleb128(b []byte, v int64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func section(b []byte, id byte, payload []byte) []byte {
+	return append(AppendUleb128(append(b, id), uint64(len(payload))), payload...)
+}
+
+func appendName(b []byte, name string) []byte {
+	return append(AppendUleb128(b, uint64(len(name))), name...)
+}
+
+func appendLimits(b []byte, l *Limits) []byte {
+	if !l.Bounded {
+		return AppendUleb128(append(b, 0), uint64(l.Min))
+	}
+	return AppendUleb128(AppendUleb128(append(b, 1), uint64(l.Min)), uint64(l.Max))
+}
+
+// appendLocals appends the local declarations of locals, grouping the runs
+// of the same type.
+func appendLocals(b []byte, locals []byte) []byte {
+	var groups []byte
+	n := 0
+	for i := 0; i < len(locals); {
+		j := i
+		for j < len(locals) && locals[j] == locals[i] {
+			j++
+		}
+		groups = append(AppendUleb128(groups, uint64(j-i)), locals[i])
+		n++
+		i = j
+	}
+	return append(AppendUleb128(b, uint64(n)), groups...)
+}
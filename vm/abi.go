@@ -0,0 +1,546 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/go-interpreter/wagon/wasm"
+	"github.com/xunleichain/tc-wasm/mock/types"
+)
+
+// ---------------------------------------------------------
+// abi
+//
+// A contract is called with the input "action|args", where args is a JSON
+// object read by the contract with the TC_Json* api. An ABI describes the
+// actions of a contract, with the name and the type of their parameters and
+// the type of their result, the string returned by the action. It is itself
+// described in JSON:
+//
+//	{"actions": [
+//	    {"name": "transfer",
+//	     "inputs": [{"name": "to", "type": "address"}, {"name": "amount", "type": "bigint"}],
+//	     "output": "string"}
+//	],
+//	 "events": [
+//	    {"name": "Transfer", "inputs": [{"name": "to", "type": "address"}]}
+//	]}
+//
+// The types follow the TC_JsonGet* getters, see abiTypes. An event is a
+// TC_Notify whose first topic is the Keccak256 of its name and whose data is
+// a JSON object holding its inputs.
+//
+// A contract may embed its ABI in the custom section ABISectionName, NewApp
+// then sets it on the APP.
+
+// ABISectionName is the name of the wasm custom section holding the ABI.
+const ABISectionName = "tc.abi"
+
+// ABIDispatchExport is the Dispatch of an ABI whose actions are the
+// functions exported by the contract, called with their inputs as arguments.
+// Values of string, address and bigint are passed as pointers to NUL
+// terminated strings, and the result of the function is returned to the
+// caller as a string.
+const ABIDispatchExport = "export"
+
+// abi types
+const (
+	ABIInt     = "int"
+	ABIInt64   = "int64"
+	ABIString  = "string"
+	ABIAddress = "address"
+	ABIBigInt  = "bigint"
+	ABIFloat   = "float"
+	ABIDouble  = "double"
+)
+
+// abiTypes are the valid types of an ABIParam, and the Go type of their
+// values: int32, int64, string, types.Address, *big.Int, float32 and float64.
+var abiTypes = map[string]bool{
+	ABIInt:     true,
+	ABIInt64:   true,
+	ABIString:  true,
+	ABIAddress: true,
+	ABIBigInt:  true,
+	ABIFloat:   true,
+	ABIDouble:  true,
+}
+
+// abiValueTypes are the wasm types of the values of the abi types.
+var abiValueTypes = map[string]wasm.ValueType{
+	ABIInt:     wasm.ValueTypeI32,
+	ABIInt64:   wasm.ValueTypeI64,
+	ABIString:  wasm.ValueTypeI32,
+	ABIAddress: wasm.ValueTypeI32,
+	ABIBigInt:  wasm.ValueTypeI32,
+	ABIFloat:   wasm.ValueTypeF32,
+	ABIDouble:  wasm.ValueTypeF64,
+}
+
+// ABI describes the actions and the events of a contract. Actions are
+// dispatched by the APPEntry of the contract, unless Dispatch is
+// ABIDispatchExport.
+type ABI struct {
+	Dispatch string       `json:"dispatch,omitempty"`
+	Actions  []*ABIAction `json:"actions"`
+	Events   []*ABIEvent  `json:"events,omitempty"`
+
+	actions map[string]*ABIAction
+	events  map[types.Hash]*ABIEvent
+}
+
+// ABIAction describes an action of a contract, Output is empty if the action
+// returns nothing.
+type ABIAction struct {
+	Name   string     `json:"name"`
+	Inputs []ABIParam `json:"inputs"`
+	Output string     `json:"output,omitempty"`
+}
+
+// ABIEvent describes an event of a contract.
+type ABIEvent struct {
+	Name   string     `json:"name"`
+	Inputs []ABIParam `json:"inputs"`
+}
+
+// Topic returns the first topic of the logs of the event.
+func (e *ABIEvent) Topic() types.Hash {
+	return types.Keccak256Hash([]byte(e.Name))
+}
+
+// ABIParam describes a parameter of an action or an event.
+type ABIParam struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// ParseABI parses and checks an ABI described in JSON.
+func ParseABI(data []byte) (*ABI, error) {
+	var abi ABI
+	if err := json.Unmarshal(data, &abi); err != nil {
+		return nil, &ABIError{Err: ErrInvalidABI, Msg: err.Error()}
+	}
+	if err := abi.init(); err != nil {
+		return nil, err
+	}
+	return &abi, nil
+}
+
+// NewABI returns an ABI of actions.
+func NewABI(actions ...*ABIAction) (*ABI, error) {
+	abi := &ABI{Actions: actions}
+	if err := abi.init(); err != nil {
+		return nil, err
+	}
+	return abi, nil
+}
+
+func (abi *ABI) init() error {
+	if abi.Dispatch != "" && abi.Dispatch != ABIDispatchExport {
+		return &ABIError{Err: ErrInvalidABI, Msg: "unknown dispatch " + abi.Dispatch}
+	}
+	abi.actions = make(map[string]*ABIAction, len(abi.Actions))
+	for _, action := range abi.Actions {
+		if action == nil || action.Name == "" || strings.IndexByte(action.Name, '|') >= 0 {
+			return &ABIError{Err: ErrInvalidABI, Msg: "bad action name"}
+		}
+		if _, ok := abi.actions[action.Name]; ok {
+			return &ABIError{Action: action.Name, Err: ErrInvalidABI, Msg: "duplicate action"}
+		}
+		if action.Output != "" && !abiTypes[action.Output] {
+			return &ABIError{Action: action.Name, Err: ErrInvalidABI, Msg: "unknown output type " + action.Output}
+		}
+		if err := checkABIParams(action.Name, action.Inputs); err != nil {
+			return err
+		}
+		abi.actions[action.Name] = action
+	}
+
+	abi.events = make(map[types.Hash]*ABIEvent, len(abi.Events))
+	for _, event := range abi.Events {
+		if event == nil || event.Name == "" {
+			return &ABIError{Err: ErrInvalidABI, Msg: "bad event name"}
+		}
+		if _, ok := abi.events[event.Topic()]; ok {
+			return &ABIError{Action: event.Name, Err: ErrInvalidABI, Msg: "duplicate event"}
+		}
+		if err := checkABIParams(event.Name, event.Inputs); err != nil {
+			return err
+		}
+		abi.events[event.Topic()] = event
+	}
+	return nil
+}
+
+func checkABIParams(name string, params []ABIParam) error {
+	names := make(map[string]bool, len(params))
+	for _, param := range params {
+		if param.Name == "" || names[param.Name] {
+			return &ABIError{Action: name, Param: param.Name, Err: ErrInvalidABI, Msg: "bad or duplicate name"}
+		}
+		if !abiTypes[param.Type] {
+			return &ABIError{Action: name, Param: param.Name, Err: ErrInvalidABI, Msg: "unknown type " + param.Type}
+		}
+		names[param.Name] = true
+	}
+	return nil
+}
+
+// Action returns the action called name.
+func (abi *ABI) Action(name string) (*ABIAction, bool) {
+	action, ok := abi.actions[name]
+	return action, ok
+}
+
+// EventByTopic returns the event whose logs have topic as first topic.
+func (abi *ABI) EventByTopic(topic types.Hash) (*ABIEvent, bool) {
+	event, ok := abi.events[topic]
+	return event, ok
+}
+
+// DecodeEvent returns the event of a log and its inputs read from data, in
+// the order of the inputs of the event.
+func (abi *ABI) DecodeEvent(topics []types.Hash, data []byte) (*ABIEvent, []interface{}, error) {
+	if len(topics) == 0 {
+		return nil, nil, &ABIError{Err: ErrABIEvent, Msg: "no topic"}
+	}
+	event, ok := abi.events[topics[0]]
+	if !ok {
+		return nil, nil, &ABIError{Err: ErrABIEvent, Msg: "unknown topic " + topics[0].Hex()}
+	}
+	values, err := decodeABIParams(event.Name, event.Inputs, string(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	return event, values, nil
+}
+
+// Marshal returns the JSON description of abi.
+func (abi *ABI) Marshal() ([]byte, error) {
+	return json.Marshal(abi)
+}
+
+// Encode returns the input calling action with args, given in the order of
+// its parameters.
+func (abi *ABI) Encode(action string, args ...interface{}) ([]byte, error) {
+	a, ok := abi.actions[action]
+	if !ok {
+		return nil, &ABIError{Action: action, Err: ErrABIAction}
+	}
+	if len(args) != len(a.Inputs) {
+		return nil, &ABIError{Action: action, Err: ErrABIArgs, Msg: "wanted " + strconv.Itoa(len(a.Inputs)) + " args"}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(action)
+	buf.WriteString("|{")
+	for i, param := range a.Inputs {
+		v, err := encodeABIValue(param.Type, args[i])
+		if err != nil {
+			return nil, &ABIError{Action: action, Param: param.Name, Err: ErrABIArgs, Msg: err.Error()}
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(param.Name)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Decode returns the action and the args of input, in the order of the
+// parameters of the action.
+func (abi *ABI) Decode(input []byte) (string, []interface{}, error) {
+	action, args, err := ParseInput(input)
+	if err != nil {
+		return "", nil, err
+	}
+	values, err := abi.decodeArgs(action, args)
+	if err != nil {
+		return "", nil, err
+	}
+	return action, values, nil
+}
+
+// Validate checks a call of action with args against abi.
+func (abi *ABI) Validate(action, args string) error {
+	_, err := abi.decodeArgs(action, args)
+	return err
+}
+
+func (abi *ABI) decodeArgs(action, args string) ([]interface{}, error) {
+	a, ok := abi.actions[action]
+	if !ok {
+		return nil, &ABIError{Action: action, Err: ErrABIAction}
+	}
+	return decodeABIParams(action, a.Inputs, args)
+}
+
+// decodeABIParams returns the values of params read from the JSON object
+// args, it fails if args holds other values.
+func decodeABIParams(name string, params []ABIParam, args string) ([]interface{}, error) {
+	obj := make(map[string]json.RawMessage)
+	if strings.TrimSpace(args) != "" {
+		if err := json.Unmarshal([]byte(args), &obj); err != nil {
+			return nil, &ABIError{Action: name, Err: ErrABIArgs, Msg: err.Error()}
+		}
+	}
+	if len(obj) > len(params) {
+		return nil, &ABIError{Action: name, Err: ErrABIArgs, Msg: "wanted " + strconv.Itoa(len(params)) + " args"}
+	}
+
+	values := make([]interface{}, len(params))
+	for i, param := range params {
+		raw, ok := obj[param.Name]
+		if !ok {
+			return nil, &ABIError{Action: name, Param: param.Name, Err: ErrABIArgs, Msg: "missing"}
+		}
+		v, err := decodeABIValue(param.Type, raw)
+		if err != nil {
+			return nil, &ABIError{Action: name, Param: param.Name, Err: ErrABIArgs, Msg: err.Error()}
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// DecodeOutput returns the value of output, the string returned by action.
+// It returns nil if the action returns nothing.
+func (abi *ABI) DecodeOutput(action string, output []byte) (interface{}, error) {
+	a, ok := abi.actions[action]
+	if !ok {
+		return nil, &ABIError{Action: action, Err: ErrABIAction}
+	}
+	if a.Output == "" {
+		return nil, nil
+	}
+	v, err := parseABIValue(a.Output, string(output))
+	if err != nil {
+		return nil, &ABIError{Action: action, Err: ErrABIOutput, Msg: err.Error()}
+	}
+	return v, nil
+}
+
+// encodeABIValue returns v of type typ in JSON. Integers and numbers are
+// encoded as JSON numbers, the others as JSON strings.
+func encodeABIValue(typ string, v interface{}) ([]byte, error) {
+	switch typ {
+	case ABIInt, ABIInt64:
+		var i int64
+		switch n := v.(type) {
+		case int:
+			i = int64(n)
+		case int32:
+			i = int64(n)
+		case int64:
+			i = n
+		case uint32:
+			i = int64(n)
+		default:
+			return nil, errABIType(typ, v)
+		}
+		if typ == ABIInt && (i < math.MinInt32 || i > math.MaxInt32) {
+			return nil, errABIRange(typ)
+		}
+		return []byte(strconv.FormatInt(i, 10)), nil
+	case ABIString:
+		s, ok := v.(string)
+		if !ok {
+			return nil, errABIType(typ, v)
+		}
+		return json.Marshal(s)
+	case ABIAddress:
+		switch a := v.(type) {
+		case types.Address:
+			return json.Marshal(strings.ToLower(a.String()))
+		case string:
+			if !types.IsHexAddress(a) {
+				return nil, errABIType(typ, v)
+			}
+			return json.Marshal(a)
+		}
+		return nil, errABIType(typ, v)
+	case ABIBigInt:
+		var b *big.Int
+		switch n := v.(type) {
+		case *big.Int:
+			b = n
+		case int:
+			b = big.NewInt(int64(n))
+		case int64:
+			b = big.NewInt(n)
+		case uint64:
+			b = new(big.Int).SetUint64(n)
+		case string:
+			var ok bool
+			if b, ok = new(big.Int).SetString(n, 0); !ok {
+				return nil, errABIType(typ, v)
+			}
+		}
+		if b == nil {
+			return nil, errABIType(typ, v)
+		}
+		return json.Marshal(b.String())
+	case ABIFloat, ABIDouble:
+		var f float64
+		switch n := v.(type) {
+		case float32:
+			f = float64(n)
+		case float64:
+			f = n
+		default:
+			return nil, errABIType(typ, v)
+		}
+		bitSize := 64
+		if typ == ABIFloat {
+			bitSize = 32
+		}
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, errABIRange(typ)
+		}
+		return []byte(strconv.FormatFloat(f, 'g', -1, bitSize)), nil
+	}
+	return nil, errABIType(typ, v)
+}
+
+// decodeABIValue returns the value of type typ in raw, read the way the
+// TC_JsonGet* api reads it.
+func decodeABIValue(typ string, raw json.RawMessage) (interface{}, error) {
+	switch typ {
+	case ABIString, ABIAddress, ABIBigInt:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		return parseABIValue(typ, s)
+	}
+	return parseABIValue(typ, string(bytes.Trim(raw, "\"")))
+}
+
+func parseABIValue(typ, s string) (interface{}, error) {
+	switch typ {
+	case ABIInt:
+		i, err := strconv.ParseInt(s, 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		return int32(i), nil
+	case ABIInt64:
+		return strconv.ParseInt(s, 0, 64)
+	case ABIString:
+		return s, nil
+	case ABIAddress:
+		if !types.IsHexAddress(s) {
+			return nil, errABIValue(typ, s)
+		}
+		return types.HexToAddress(s), nil
+	case ABIBigInt:
+		b, ok := new(big.Int).SetString(s, 0)
+		if !ok {
+			return nil, errABIValue(typ, s)
+		}
+		return b, nil
+	case ABIFloat:
+		f, err := strconv.ParseFloat(s, 32)
+		if err != nil {
+			return nil, err
+		}
+		return float32(f), nil
+	case ABIDouble:
+		return strconv.ParseFloat(s, 64)
+	}
+	return nil, errABIValue(typ, s)
+}
+
+func errABIType(typ string, v interface{}) error {
+	return fmt.Errorf("%T is not %s", v, typ)
+}
+
+func errABIRange(typ string) error {
+	return fmt.Errorf("out of %s range", typ)
+}
+
+func errABIValue(typ, s string) error {
+	return fmt.Errorf("%q is not %s", s, typ)
+}
+
+// readABI returns the ABI embedded in m, nil if there is none.
+func readABI(m *wasm.Module) (*ABI, error) {
+	s := m.Custom(ABISectionName)
+	if s == nil {
+		return nil, nil
+	}
+	return ParseABI(s.Data)
+}
+
+// CheckABI checks that the actions declared in the ABI of app can be called.
+// The app must export the APPEntry dispatching them, or with export dispatch
+// a function per action whose signature matches its inputs and output. It is
+// called when the contract is created.
+func (app *APP) CheckABI() error {
+	if app.ExportDispatch() {
+		for _, action := range app.ABI.Actions {
+			if err := app.checkExport(action); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if app.ABI == nil || len(app.ABI.Actions) == 0 {
+		return nil
+	}
+	fnIndex := app.GetEntryFunction()
+	if fnIndex < 0 {
+		return &ABIError{Err: ErrABIExport, Msg: "no " + app.EntryFunc}
+	}
+	fn := app.Module.GetFunction(int(fnIndex))
+	if fn == nil || len(fn.Sig.ParamTypes) != 2 || len(fn.Sig.ReturnTypes) != 1 {
+		return &ABIError{Err: ErrABIExport, Msg: "bad signature of " + app.EntryFunc}
+	}
+	return nil
+}
+
+func (app *APP) checkExport(action *ABIAction) error {
+	fnIndex := app.GetExportFunction(action.Name)
+	if fnIndex < 0 {
+		return &ABIError{Action: action.Name, Err: ErrABIExport}
+	}
+	sig := app.Module.GetFunction(int(fnIndex)).Sig
+	if len(sig.ParamTypes) != len(action.Inputs) {
+		return &ABIError{Action: action.Name, Err: ErrABIExport, Msg: "declared as " + sig.String()}
+	}
+	for i, param := range action.Inputs {
+		if sig.ParamTypes[i] != abiValueTypes[param.Type] {
+			return &ABIError{Action: action.Name, Param: param.Name, Err: ErrABIExport, Msg: "declared as " + sig.String()}
+		}
+	}
+	switch {
+	case action.Output == "" && len(sig.ReturnTypes) == 0:
+	case action.Output != "" && len(sig.ReturnTypes) == 1 && sig.ReturnTypes[0] == abiValueTypes[action.Output]:
+	default:
+		return &ABIError{Action: action.Name, Err: ErrABIExport, Msg: "declared as " + sig.String()}
+	}
+	return nil
+}
+
+// validateCall checks a call of action with args against the ABI of app, if
+// any. Init is only checked when the ABI declares it.
+func (app *APP) validateCall(action, args string) error {
+	if app.ABI == nil {
+		return nil
+	}
+	if action == "Init" || action == "init" {
+		if _, ok := app.ABI.Action(action); !ok {
+			return nil
+		}
+	}
+	return app.ABI.Validate(action, args)
+}
@@ -26,6 +26,7 @@ type AotService struct {
 	black    map[string]struct{}
 	succ     map[string]*Native
 	onDelete map[string]*Native
+	refs     map[string]int
 	lock     sync.Mutex
 	logger   log.Logger
 }
@@ -48,6 +49,7 @@ func NewAotService(path string, keepSrouce bool) *AotService {
 		black:       make(map[string]struct{}),
 		succ:        make(map[string]*Native, 32),
 		onDelete:    make(map[string]*Native, 8),
+		refs:        make(map[string]int, 32),
 	}
 
 	return &s
@@ -63,7 +65,15 @@ func GetNative(app *APP) *Native {
 	return aots.getNative(app)
 }
 
-// DeleteNative --
+// RetainNative counts app, held by an AppCache, as a user of the native code
+// of its key, see DeleteNative.
+func RetainNative(app *APP) {
+	aots.retainNative(app)
+}
+
+// DeleteNative releases the native code of app, held by an AppCache. The
+// native code is shared by the code hash, it is only deleted once no cached
+// app uses it.
 func DeleteNative(app *APP) {
 	aots.deleteNative(app)
 }
@@ -83,12 +93,18 @@ type ContractInfo struct {
 	Err  string   `json:"e"`
 }
 
+// aotKey returns the key of the native code of app. The same code deployed
+// at several addresses is compiled once, so the key is the hash of the code.
+func aotKey(app *APP) string {
+	return hex.EncodeToString(app.md5[:])
+}
+
 func (s *AotService) checkApp(app *APP) {
 	if !enableAots {
 		return
 	}
 
-	name := app.String()
+	name := aotKey(app)
 	s.lock.Lock()
 	if _, ok := s.black[name]; !ok {
 		if _, ok := s.succ[name]; !ok {
@@ -106,7 +122,7 @@ func (s *AotService) getNative(app *APP) *Native {
 	if !enableAots {
 		return nil
 	}
-	name := app.String()
+	name := aotKey(app)
 
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -115,13 +131,30 @@ func (s *AotService) getNative(app *APP) *Native {
 	return native.clone(app)
 }
 
+func (s *AotService) retainNative(app *APP) {
+	if !enableAots {
+		return
+	}
+
+	name := aotKey(app)
+	s.lock.Lock()
+	s.refs[name]++
+	s.lock.Unlock()
+}
+
 func (s *AotService) deleteNative(app *APP) {
 	if !enableAots {
 		return
 	}
 
-	name := app.String()
+	name := aotKey(app)
 	s.lock.Lock()
+	if s.refs[name] > 1 {
+		s.refs[name]--
+		s.lock.Unlock()
+		return
+	}
+	delete(s.refs, name)
 
 	native := s.onDelete[name]
 	if native == nil {
@@ -151,7 +184,7 @@ func (s *AotService) loop() {
 	for {
 		select {
 		case app := <-s.refresh:
-			name := app.String()
+			name := aotKey(app)
 			s.lock.Lock()
 			if _, ok := s.black[name]; ok {
 				s.lock.Unlock()
@@ -225,7 +258,7 @@ func (s *AotService) doCheck(app *APP) error {
 		return s.doWork(app)
 	}
 
-	name := app.String()
+	name := aotKey(app)
 	// @Note: now we only support wasm
 	if info.Type != "wasm" {
 		app.Printf("[AotService] Not wasm contract, skip it: app:%s", name)
@@ -299,7 +332,7 @@ func (s *AotService) doLoad(app *APP, info *ContractInfo) error {
 	if native != nil {
 		app.Printf("[AotService] NewNative ok: app:%s, md5:%s", app.String(), hex.EncodeToString(app.md5[:]))
 		s.lock.Lock()
-		s.succ[app.String()] = native
+		s.succ[aotKey(app)] = native
 		s.lock.Unlock()
 	}
 	return err
@@ -313,13 +346,14 @@ func (s *AotService) doCompile(app *APP) (*ContractInfo, error) {
 
 	// exec.SetCGenLogger(app.logger) // for debug
 	ctx := exec.NewCGenContext(app.VM, s.keepCSource)
+	ctx.DisableGas(app.metered)
 	code, err := ctx.Generate()
 	if err != nil {
 		info.Err = "Generate C Code Fail"
 		return &info, err
 	}
 
-	name := app.String()
+	name := aotKey(app)
 	file, err := ctx.Compile(code, s.path, name)
 	if err != nil {
 		info.Err = "Compile C Code Fail"
@@ -341,7 +375,7 @@ const (
 )
 
 func (s *AotService) updateContractInfo(app *APP, info *ContractInfo) {
-	name := app.String()
+	name := aotKey(app)
 
 	if info.Err != "" {
 		s.lock.Lock()
@@ -355,24 +389,33 @@ func (s *AotService) updateContractInfo(app *APP, info *ContractInfo) {
 		return
 	}
 
-	key := make([]byte, contractInfoPrefixLen+len(name))
-	copy(key[:contractInfoPrefixLen], contractInfoPrefix)
-	copy(key[contractInfoPrefixLen:], []byte(name))
-
 	stateDB := app.Eng.State
-	stateDB.SetContractInfo(key, data)
+	stateDB.SetContractInfo(contractInfoKey(name), data)
 }
 
-func (s *AotService) getContractInfo(app *APP) *ContractInfo {
-	name := app.String()
+// contractInfoKey returns the StateDB key of the ContractInfo of name.
+func contractInfoKey(name string) []byte {
 	key := make([]byte, contractInfoPrefixLen+len(name))
 	copy(key[:contractInfoPrefixLen], contractInfoPrefix)
 	copy(key[contractInfoPrefixLen:], []byte(name))
+	return key
+}
+
+func (s *AotService) getContractInfo(app *APP) *ContractInfo {
+	name := aotKey(app)
+	key := contractInfoKey(name)
 
 	stateDB := app.Eng.State
 	data := stateDB.GetContractInfo(key)
 	if len(data) == 0 {
-		return nil
+		// The ContractInfo used to be stored per contract, under app.String(),
+		// move it to the key of the code.
+		data = stateDB.GetContractInfo(contractInfoKey(app.String()))
+		if len(data) == 0 {
+			return nil
+		}
+		stateDB.SetContractInfo(key, data)
+		app.Printf("[AotService] ContractInfo migrated: app:%s, key:%s", app.String(), name)
 	}
 
 	var info ContractInfo
@@ -0,0 +1,167 @@
+package vm
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/xunleichain/tc-wasm/mock/log"
+	"github.com/xunleichain/tc-wasm/mock/state"
+	"github.com/xunleichain/tc-wasm/mock/types"
+	"github.com/xunleichain/tc-wasm/mock/wasmtest"
+)
+
+// entryCode returns a contract with an empty table, one page of memory and
+// __heap_base, whose entry runs body.
+func entryCode(body ...byte) []byte {
+	i32 := wasmtest.I32
+	m := wasmtest.Module{
+		Types:   []wasmtest.Type{{Params: []byte{i32, i32}, Results: []byte{i32}}},
+		Funcs:   []wasmtest.Func{{Code: body}},
+		Table:   &wasmtest.Limits{},
+		Memory:  &wasmtest.Limits{Min: 1},
+		Globals: []wasmtest.Global{{Type: i32, Init: wasmtest.I32Const(4096)}},
+		Exports: []wasmtest.Export{
+			{Name: APPEntry, Kind: wasmtest.KindFunc, Index: 0},
+			{Name: "__heap_base", Kind: wasmtest.KindGlobal, Index: 0},
+		},
+	}
+	return m.Bytes()
+}
+
+func TestAotSharedNative(t *testing.T) {
+	enableAots = true
+	defer func() { enableAots = false }()
+
+	code := entryCode(0x41, 0)
+	st, _ := state.New()
+	addrs := []types.Address{types.BytesToAddress([]byte{1}), types.BytesToAddress([]byte{2})}
+	for _, addr := range addrs {
+		st.SetCode(addr, code)
+	}
+
+	cache := NewAppCache(0, 0)
+	hasNative := func(addr types.Address) bool {
+		contract := NewContract(addr.Bytes(), addr.Bytes(), big.NewInt(0), 0)
+		eng := NewEngine(contract, 100000, st, log.Test(), cache, nil)
+		app, err := eng.NewApp(addr.String(), nil, false)
+		if err != nil {
+			t.Fatalf("new app fail: %v", err)
+		}
+		defer app.Close()
+		return app.native != nil
+	}
+
+	// the first load compiles the code in the background, the other
+	// addresses of the code use it as well
+	deadline := time.Now().Add(time.Minute)
+	for !hasNative(addrs[0]) {
+		if time.Now().After(deadline) {
+			t.Fatalf("code not compiled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !hasNative(addrs[1]) {
+		t.Fatalf("%s: native code not found", addrs[1].String())
+	}
+}
+
+func TestAotNativeRefs(t *testing.T) {
+	enableAots = true
+	defer func() { enableAots = false }()
+
+	code := entryCode(0x41, 1)
+	st, _ := state.New()
+	addr := types.BytesToAddress([]byte{3})
+	st.SetCode(addr, code)
+	hash := st.GetCodeHash(addr)
+
+	caches := []*AppCache{NewAppCache(0, 0), NewAppCache(0, 0)}
+	load := func(cache *AppCache) *APP {
+		contract := NewContract(addr.Bytes(), addr.Bytes(), big.NewInt(0), 0)
+		eng := NewEngine(contract, 100000, st, log.Test(), cache, nil)
+		app, err := eng.NewApp(addr.String(), nil, false)
+		if err != nil {
+			t.Fatalf("new app fail: %v", err)
+		}
+		return app
+	}
+	hasNative := func(cache *AppCache) bool {
+		app := load(cache)
+		defer app.Close()
+		return app.native != nil
+	}
+
+	deadline := time.Now().Add(time.Minute)
+	for !hasNative(caches[0]) {
+		if time.Now().After(deadline) {
+			t.Fatalf("code not compiled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	app := load(caches[1])
+	app.Close()
+
+	// replacing the contract cached for the code keeps the native code
+	contract := NewContract(addr.Bytes(), addr.Bytes(), big.NewInt(0), 0)
+	eng := NewEngine(contract, 100000, st, log.Test(), caches[1], nil)
+	replaced, err := NewApp(addr.String(), code, eng, false, log.Test(), nil)
+	if err != nil {
+		t.Fatalf("new app fail: %v", err)
+	}
+	caches[1].Add(hash, replaced, appSize(replaced, code))
+	if !hasNative(caches[1]) {
+		t.Fatalf("native code deleted by replace")
+	}
+
+	// the native code is deleted with the last cached contract using it
+	caches[0].Remove(hash)
+	if !hasNative(caches[1]) {
+		t.Fatalf("native code deleted while still cached")
+	}
+	caches[1].Remove(hash)
+	aots.lock.Lock()
+	native, refs := aots.succ[aotKey(app)], aots.refs[aotKey(app)]
+	aots.lock.Unlock()
+	if native != nil || refs != 0 {
+		t.Fatalf("native code not deleted: refs(%d)", refs)
+	}
+}
+
+// infoState keeps the ContractInfo by the whole key, which the mock StateDB
+// truncates to an address.
+type infoState struct {
+	*state.StateDB
+	infos map[string][]byte
+}
+
+func (s *infoState) GetContractInfo(key []byte) []byte {
+	return s.infos[string(key)]
+}
+
+func (s *infoState) SetContractInfo(key, info []byte) {
+	s.infos[string(key)] = info
+}
+
+func TestAotContractInfoMigration(t *testing.T) {
+	code := entryCode(0x41, 2)
+	st, _ := state.New()
+	db := &infoState{StateDB: st, infos: make(map[string][]byte)}
+	addr := types.BytesToAddress([]byte{4})
+	contract := NewContract(addr.Bytes(), addr.Bytes(), big.NewInt(0), 0)
+	eng := NewEngine(contract, 100000, db, log.Test(), NewAppCache(0, 0), nil)
+	app, err := NewApp(addr.String(), code, eng, false, log.Test(), nil)
+	if err != nil {
+		t.Fatalf("new app fail: %v", err)
+	}
+
+	legacy := []byte(`{"t":"wasm","p":"/tmp/legacy.so","e":""}`)
+	db.SetContractInfo(contractInfoKey(app.String()), legacy)
+	info := aots.getContractInfo(app)
+	if info == nil || info.Path != "/tmp/legacy.so" {
+		t.Fatalf("legacy info not read: %+v", info)
+	}
+	if got := db.GetContractInfo(contractInfoKey(aotKey(app))); string(got) != string(legacy) {
+		t.Fatalf("legacy info not migrated: got(%s)", got)
+	}
+}
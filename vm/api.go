@@ -724,7 +724,7 @@ func tcAssert(eng *Engine, index int64, args []uint64) (uint64, error) {
 	condition := int(args[0])
 	if condition == 0 {
 		eng.Logger().Debug("WASM RUN LOG:call TC_assert")
-		return 0, ErrExecutionReverted
+		return 0, eng.revert(nil)
 	}
 	return 0, nil
 }
@@ -796,7 +796,7 @@ func tcRequire(eng *Engine, index int64, args []uint64) (uint64, error) {
 		// app.VmProcess.Terminate()
 		eng.Logger().Debug("WASM RUN LOG:call TC_require")
 
-		return 0, ErrExecutionReverted
+		return 0, eng.revert(nil)
 	}
 	return 0, nil
 }
@@ -852,7 +852,7 @@ func tcRequireWithMsg(eng *Engine, index int64, args []uint64) (uint64, error) {
 		//TODO: write log
 		// eng.State.AddLog()
 		eng.Logger().Info("WASM RUN LOG:call TC_requireWithMsg", "msg", msg)
-		return 0, ErrExecutionReverted
+		return 0, eng.revert(a)
 	}
 	return 0, nil
 }
@@ -876,7 +876,7 @@ func tcRevert(eng *Engine, index int64, args []uint64) (uint64, error) {
 	// TODO:write log
 	eng.Logger().Debug("WASM RUN LOG:call TC_revert")
 
-	return 0, ErrExecutionReverted
+	return 0, eng.revert(nil)
 }
 
 type TCRevertWithMsg struct{}
@@ -906,7 +906,7 @@ func tcRevertWithMsg(eng *Engine, index int64, args []uint64) (uint64, error) {
 
 	// TODO:write log
 	eng.Logger().Info("WASM RUN LOG:call TC_revertWithMsg", "msg", msg)
-	return 0, ErrExecutionReverted
+	return 0, eng.revert(a)
 }
 
 type TCPayable struct{}
@@ -0,0 +1,325 @@
+package vm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/big"
+
+	"github.com/xunleichain/tc-wasm/mock/types"
+	"golang.org/x/crypto/ripemd160"
+	"golang.org/x/crypto/sha3"
+)
+
+// ---------------------------------------------------------
+// tc2 api
+//
+// The tc2_* functions are a second generation of the host api for contracts
+// not written in C. Data is passed as (ptr, len) pairs instead of NUL
+// terminated strings, so it may hold zero bytes. Variable sized results are
+// written into a buffer (out, cap) given by the caller: at most cap bytes are
+// copied and the full size is returned, a result larger than cap is
+// truncated. Addresses are 20 raw bytes, hashes 32 raw bytes and amounts 32
+// bytes big-endian.
+
+// Amount2Size is the size of an amount in the tc2 api.
+const Amount2Size = 32
+
+// ReadMemory returns size bytes at ptr in the memory of the running frame.
+func (eng *Engine) ReadMemory(ptr, size uint64) ([]byte, error) {
+	app, _ := eng.RunningAppFrame()
+	if app == nil {
+		return nil, ErrEmptyFrame
+	}
+	mem := app.VM.VMemory().Memory
+	if ptr > uint64(len(mem)) || size > uint64(len(mem))-ptr {
+		return nil, ErrMemoryGet
+	}
+	data := make([]byte, size)
+	copy(data, mem[ptr:ptr+size])
+	return data, nil
+}
+
+// WriteMemory copies data at ptr in the memory of the running frame.
+func (eng *Engine) WriteMemory(ptr uint64, data []byte) error {
+	app, _ := eng.RunningAppFrame()
+	if app == nil {
+		return ErrEmptyFrame
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if _, err := app.VM.VMemory().CopyBytes(data, ptr); err != nil {
+		return ErrMemorySet
+	}
+	return nil
+}
+
+// WriteBuffer copies at most size bytes of data at ptr in the memory of the
+// running frame, and returns the length of data.
+func (eng *Engine) WriteBuffer(ptr, size uint64, data []byte) (uint64, error) {
+	n := uint64(len(data))
+	if n > size {
+		n = size
+	}
+	if err := eng.WriteMemory(ptr, data[:n]); err != nil {
+		return 0, err
+	}
+	return uint64(len(data)), nil
+}
+
+// ReadAddress returns the address at ptr in the memory of the running frame.
+func (eng *Engine) ReadAddress(ptr uint64) (types.Address, error) {
+	b, err := eng.ReadMemory(ptr, types.AddressLength)
+	if err != nil {
+		return types.Address{}, err
+	}
+	return types.BytesToAddress(b), nil
+}
+
+// ReadAmount returns the amount at ptr in the memory of the running frame.
+func (eng *Engine) ReadAmount(ptr uint64) (*big.Int, error) {
+	b, err := eng.ReadMemory(ptr, Amount2Size)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// WriteAmount writes v at ptr in the memory of the running frame.
+func (eng *Engine) WriteAmount(ptr uint64, v *big.Int) error {
+	if v.Sign() < 0 || v.BitLen() > 8*Amount2Size {
+		return ErrInvalidApiArgs
+	}
+	var b [Amount2Size]byte
+	vb := v.Bytes()
+	copy(b[Amount2Size-len(vb):], vb)
+	return eng.WriteMemory(ptr, b[:])
+}
+
+// splitInput returns the action and the args of input.
+func splitInput(input []byte) (action, args []byte) {
+	if i := bytes.IndexByte(input, '|'); i >= 0 {
+		return input[:i], input[i+1:]
+	}
+	return input, nil
+}
+
+type TC2Action struct{}
+
+func (t *TC2Action) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tc2Action(eng, index, args)
+}
+func (t *TC2Action) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return gasGetMsgSign(eng, index, args)
+}
+
+// uint32_t tc2_action(uint8_t *out, uint32_t cap)
+func tc2Action(eng *Engine, index int64, args []uint64) (uint64, error) {
+	action, _ := splitInput(eng.Contract.Input)
+	return eng.WriteBuffer(args[0], args[1], action)
+}
+
+type TC2Args struct{}
+
+func (t *TC2Args) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tc2Args(eng, index, args)
+}
+func (t *TC2Args) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return gasGetMsgData(eng, index, args)
+}
+
+// uint32_t tc2_args(uint8_t *out, uint32_t cap)
+func tc2Args(eng *Engine, index int64, args []uint64) (uint64, error) {
+	_, params := splitInput(eng.Contract.Input)
+	return eng.WriteBuffer(args[0], args[1], params)
+}
+
+type TC2Sender struct{}
+
+func (t *TC2Sender) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tc2Sender(eng, index, args)
+}
+func (t *TC2Sender) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return gasGetMsgSender(eng, index, args)
+}
+
+// void tc2_sender(uint8_t out[20])
+func tc2Sender(eng *Engine, index int64, args []uint64) (uint64, error) {
+	return 0, eng.WriteMemory(args[0], eng.Contract.CallerAddress.Bytes())
+}
+
+type TC2SelfAddress struct{}
+
+func (t *TC2SelfAddress) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tc2SelfAddress(eng, index, args)
+}
+func (t *TC2SelfAddress) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return gasGetSelfAddress(eng, index, args)
+}
+
+// void tc2_self_address(uint8_t out[20])
+func tc2SelfAddress(eng *Engine, index int64, args []uint64) (uint64, error) {
+	return 0, eng.WriteMemory(args[0], eng.Contract.Self.Address().Bytes())
+}
+
+type TC2CallContract struct{}
+
+func (t *TC2CallContract) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tc2CallContract(eng, index, args)
+}
+func (t *TC2CallContract) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return gasTC2CallContract(eng, index, args)
+}
+
+// uint32_t tc2_call_contract(const uint8_t addr[20], const uint8_t *action, uint32_t action_len, const uint8_t *args, uint32_t args_len, uint8_t *out, uint32_t cap)
+func tc2CallContract(eng *Engine, index int64, args []uint64) (uint64, error) {
+	addr, err := eng.ReadAddress(args[0])
+	if err != nil {
+		return 0, err
+	}
+	action, err := eng.ReadMemory(args[1], args[2])
+	if err != nil {
+		return 0, err
+	}
+	params, err := eng.ReadMemory(args[3], args[4])
+	if err != nil {
+		return 0, err
+	}
+
+	toFrame, err := eng.NewApp(addr.String(), nil, false)
+	if err != nil {
+		return 0, err
+	}
+	contract := NewContractInner(eng.Contract, AccountRef(addr), big.NewInt(0), eng.Gas())
+	eng.logger.Debug("[Engine] tc2_call_contract", "app", addr.String(), "action", string(action), "params", string(params))
+	ret, err := eng.callFrameData(toFrame, contract, action, params)
+	if err != nil {
+		return 0, err
+	}
+	return eng.WriteBuffer(args[5], args[6], ret)
+}
+
+type TC2Require struct{}
+
+func (t *TC2Require) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tc2Require(eng, index, args)
+}
+func (t *TC2Require) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	return gasTC2Print(args[2])
+}
+
+// void tc2_require(bool condition, const uint8_t *msg, uint32_t msg_len)
+func tc2Require(eng *Engine, index int64, args []uint64) (uint64, error) {
+	if args[0] != 0 {
+		return 0, nil
+	}
+	msg, err := eng.ReadMemory(args[1], args[2])
+	if err != nil {
+		return 0, err
+	}
+	eng.Logger().Info("WASM RUN LOG:call tc2_require", "msg", string(msg))
+	return 0, eng.revert(msg)
+}
+
+type TC2Revert struct{}
+
+func (t *TC2Revert) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tc2Revert(eng, index, args)
+}
+func (t *TC2Revert) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	return gasTC2Print(args[1])
+}
+
+// void tc2_revert(const uint8_t *msg, uint32_t msg_len)
+func tc2Revert(eng *Engine, index int64, args []uint64) (uint64, error) {
+	msg, err := eng.ReadMemory(args[0], args[1])
+	if err != nil {
+		return 0, err
+	}
+	eng.Logger().Info("WASM RUN LOG:call tc2_revert", "msg", string(msg))
+	return 0, eng.revert(msg)
+}
+
+type TC2Print struct{}
+
+func (t *TC2Print) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tc2Print(eng, index, args)
+}
+func (t *TC2Print) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	return gasTC2Print(args[1])
+}
+
+// void tc2_print(const uint8_t *data, uint32_t len)
+func tc2Print(eng *Engine, index int64, args []uint64) (uint64, error) {
+	data, err := eng.ReadMemory(args[0], args[1])
+	if err != nil {
+		return 0, err
+	}
+	eng.Logger().Info("WASM RUN LOG: " + string(data))
+	return 0, nil
+}
+
+type TC2Keccak256 struct{}
+
+func (t *TC2Keccak256) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tc2Hash(eng, args, func(data []byte) []byte {
+		d := sha3.NewLegacyKeccak256()
+		d.Write(data)
+		return d.Sum(nil)
+	})
+}
+func (t *TC2Keccak256) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	return gasTC2Hash(args[1], HashSetGas, Sha3WordGas)
+}
+
+type TC2Sha256 struct{}
+
+func (t *TC2Sha256) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tc2Hash(eng, args, func(data []byte) []byte {
+		hash := sha256.Sum256(data)
+		return hash[:]
+	})
+}
+func (t *TC2Sha256) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	return gasTC2Hash(args[1], HashSetGas, Sha256PerWordGas)
+}
+
+type TC2Ripemd160 struct{}
+
+func (t *TC2Ripemd160) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tc2Hash(eng, args, func(data []byte) []byte {
+		d := ripemd160.New()
+		d.Write(data)
+		return d.Sum(nil)
+	})
+}
+func (t *TC2Ripemd160) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	return gasTC2Hash(args[1], AddrSetGas, Ripemd160PerWordGas)
+}
+
+// void tc2_keccak256(const uint8_t *data, uint32_t len, uint8_t out[32])
+// void tc2_sha256(const uint8_t *data, uint32_t len, uint8_t out[32])
+// void tc2_ripemd160(const uint8_t *data, uint32_t len, uint8_t out[20])
+func tc2Hash(eng *Engine, args []uint64, hash func([]byte) []byte) (uint64, error) {
+	data, err := eng.ReadMemory(args[0], args[1])
+	if err != nil {
+		return 0, err
+	}
+	return 0, eng.WriteMemory(args[2], hash(data))
+}
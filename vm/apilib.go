@@ -293,3 +293,70 @@ func tcIsHexAddress(eng *Engine, index int64, args []uint64) (uint64, error) {
 	}
 	return ret, err
 }
+
+type TCSetReturnData struct{}
+
+func (t *TCSetReturnData) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tcSetReturnData(eng, index, args)
+}
+func (t *TCSetReturnData) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return gasSetReturnData(eng, index, args)
+}
+
+//void TC_SetReturnData(const uint8_t *data, uint32_t len)
+func tcSetReturnData(eng *Engine, index int64, args []uint64) (uint64, error) {
+	data, err := eng.ReadMemory(args[0], args[1])
+	if err != nil {
+		return 0, err
+	}
+	eng.SetReturnData(data)
+	return 0, nil
+}
+
+type TCReturnDataSize struct{}
+
+func (t *TCReturnDataSize) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tcReturnDataSize(eng, index, args)
+}
+func (t *TCReturnDataSize) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	return GasQuickStep, nil
+}
+
+//uint32_t TC_ReturnDataSize()
+func tcReturnDataSize(eng *Engine, index int64, args []uint64) (uint64, error) {
+	return uint64(len(eng.callResult)), nil
+}
+
+type TCReturnDataCopy struct{}
+
+func (t *TCReturnDataCopy) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tcReturnDataCopy(eng, index, args)
+}
+func (t *TCReturnDataCopy) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return gasReturnDataCopy(eng, index, args)
+}
+
+//void TC_ReturnDataCopy(uint8_t *dest, uint32_t offset, uint32_t len)
+func tcReturnDataCopy(eng *Engine, index int64, args []uint64) (uint64, error) {
+	offset, size := args[1], args[2]
+	if offset > uint64(len(eng.callResult)) || size > uint64(len(eng.callResult))-offset {
+		return 0, ErrReturnDataOutOfBounds
+	}
+	return 0, eng.WriteMemory(args[0], eng.callResult[offset:offset+size])
+}
+
+type TCGas struct{}
+
+func (t *TCGas) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	return 0, nil
+}
+
+// The cost passed by the code Instrument injects is the gas of the call.
+func (t *TCGas) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	return args[0], nil
+}
@@ -6,12 +6,16 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"math"
+	"math/big"
+	"strconv"
 
 	"github.com/go-interpreter/wagon/disasm"
 	"github.com/go-interpreter/wagon/exec"
 	"github.com/go-interpreter/wagon/validate"
 	"github.com/go-interpreter/wagon/wasm"
 	"github.com/xunleichain/tc-wasm/mock/log"
+	"github.com/xunleichain/tc-wasm/mock/types"
 )
 
 const (
@@ -44,25 +48,37 @@ type APP struct {
 	IsPreRun  bool
 	EntryFunc string
 
+	// ABI, if set, describes the actions of the app, calls are checked
+	// against it before running.
+	ABI *ABI
+
 	native *Native
 
+	// metered is set if the code of app was rewritten by Instrument, its
+	// instructions are then charged by the gas calls injected.
+	metered bool
+
 	result interface{}
 
 	md5 [16]byte
 }
 
-// Clone just copy
-func (app *APP) Clone(eng *Engine) *APP {
+// Clone returns a new instance of app run by eng as the contract at name.
+func (app *APP) Clone(eng *Engine, name string) *APP {
 	vm := app.VM.Clone(eng)
 	vm.RecoverPanic = true
+	vm.DisableGas(app.metered)
+	eng.limits.capMemory(vm)
 	newApp := &APP{
 		logger:    app.logger,
-		Name:      app.Name,
+		Name:      name,
 		Module:    app.Module,
 		Eng:       eng,
 		VM:        vm,
 		VmProcess: exec.NewProcess(vm),
 		EntryFunc: app.EntryFunc,
+		ABI:       app.ABI,
+		metered:   app.metered,
 		md5:       app.md5,
 	}
 	newApp.native = GetNative(newApp)
@@ -81,25 +97,60 @@ func (app *APP) String() string {
 	return fmt.Sprintf("%s-%s", app.Name, hex.EncodeToString(app.md5[:]))
 }
 
-// NewApp new wasm app module
-func NewApp(name string, code []byte, eng *Engine, debug bool, logger log.Logger) (*APP, error) {
+// NewApp new wasm app module, code is rejected if it exceeds limits,
+// DefaultLimits if nil. If eng has a GasSchedule, code is instrumented with
+// it once checked.
+func NewApp(name string, code []byte, eng *Engine, debug bool, logger log.Logger, limits *Limits) (*APP, error) {
 	if debug {
 		disasm.SetLogger(logger)
 		wasm.SetLogger(logger)
 		validate.SetLogger(logger)
 	}
+	if limits == nil {
+		limits = &DefaultLimits
+	}
+	if err := limits.checkCode(code); err != nil {
+		return nil, err
+	}
+	// ReadModule allocates the memory and the tables, check them first.
+	dm, err := wasm.DecodeModule(bytes.NewReader(code))
+	if err != nil {
+		return nil, fmt.Errorf("wasm.DecodeModule fail: %s", err)
+	}
+	if err := limits.checkModule(dm); err != nil {
+		return nil, err
+	}
+	if schedule := eng.GasSchedule(); schedule != nil {
+		if code, err = Instrument(code, schedule); err != nil {
+			return nil, fmt.Errorf("Instrument fail: %s", err)
+		}
+	}
 
 	reader := bytes.NewReader(code)
-	m, err := wasm.ReadModule(reader, eng.EnvTable().resolveImport)
+	m, err := wasm.ReadModule(reader, eng.importTable().resolveImport)
 	if err != nil {
+		switch e := err.(type) {
+		case *ImportError:
+			return nil, e
+		case wasm.ExportNotFoundError:
+			return nil, &ImportError{Module: e.ModuleName, Field: e.FieldName, Err: ErrImportFunc}
+		}
 		return nil, fmt.Errorf("wasm.ReadMoudle fail: %s", err)
 	}
+	if err := eng.importTable().checkImports(m); err != nil {
+		return nil, err
+	}
 
 	err = validate.VerifyModule(m)
 	if err != nil {
 		return nil, fmt.Errorf("validate.VerifyMoudle fail: %s", err)
 	}
 
+	abi, err := readABI(m)
+	if err != nil {
+		return nil, err
+	}
+
 	md5 := md5.Sum(code)
 
 	app := &APP{
@@ -109,6 +160,8 @@ func NewApp(name string, code []byte, eng *Engine, debug bool, logger log.Logger
 		Module:    m,
 		Eng:       eng,
 		EntryFunc: APPEntry,
+		ABI:       abi,
+		metered:   eng.GasSchedule() != nil,
 		md5:       md5,
 	}
 
@@ -116,6 +169,8 @@ func NewApp(name string, code []byte, eng *Engine, debug bool, logger log.Logger
 	if err != nil {
 		return nil, fmt.Errorf("exec.NewVM fail: %s", err)
 	}
+	limits.capMemory(vm)
+	vm.DisableGas(app.metered)
 	app.VM = vm
 
 	return app, nil
@@ -209,6 +264,10 @@ func ParseInitArgsAndCode(data []byte) ([]byte, []byte, error) {
 // Run execute AppEntry Function
 // the input format should be "action | args"
 func (app *APP) Run(action, args string) (uint64, error) {
+	if !app.IsPreRun && app.ExportDispatch() {
+		return app.runExport(action, args)
+	}
+
 	if !app.IsPreRun && app.native != nil {
 		return app.native.RunCMain(action, args)
 	}
@@ -239,6 +298,158 @@ func (app *APP) Run(action, args string) (uint64, error) {
 	return app.RunF(fnIndex, params...)
 }
 
+// ExportDispatch reports whether the actions of app are its exported
+// functions, see ABIDispatchExport.
+func (app *APP) ExportDispatch() bool {
+	return app.ABI != nil && app.ABI.Dispatch == ABIDispatchExport
+}
+
+// runningFunc returns the index of the function app was running when it
+// stopped, -1 if unknown.
+func (app *APP) runningFunc() int64 {
+	if app.native != nil && !app.IsPreRun {
+		return app.native.fn
+	}
+	return app.VM.CurrentFunc()
+}
+
+// runExport calls the function exported as action with args, natively if
+// the native code of app dispatches it. A missing Init is not an error, the
+// contract has no constructor.
+func (app *APP) runExport(action, args string) (uint64, error) {
+	fnIndex := app.GetExportFunction(action)
+	if fnIndex < 0 {
+		if action == "Init" || action == "init" {
+			return 0, nil
+		}
+		return 0, &ABIError{Action: action, Err: ErrABIExport}
+	}
+	params, err := app.exportParams(fnIndex, action, args)
+	if err != nil {
+		return 0, err
+	}
+
+	if app.nativeExport(fnIndex) {
+		bits, err := app.native.RunExport(fnIndex, params...)
+		if err != nil {
+			return 0, err
+		}
+		return app.exportResult(action, exportValue(app.Module.GetFunction(int(fnIndex)).Sig, bits))
+	}
+
+	if err := app.VM.PreRun(fnIndex, params...); err != nil {
+		return 0, err
+	}
+	app.IsPreRun = true
+	ret, err := app.VM.Run()
+	if err != nil {
+		return 0, err
+	}
+	return app.exportResult(action, ret)
+}
+
+// exportParams returns the arguments of the function at fnIndex, read from
+// args as the inputs of action.
+func (app *APP) exportParams(fnIndex int64, action, args string) ([]uint64, error) {
+	sig := app.Module.GetFunction(int(fnIndex)).Sig
+	a, ok := app.ABI.Action(action)
+	if !ok {
+		// an undeclared Init, see validateCall
+		if len(sig.ParamTypes) != 0 {
+			return nil, &ABIError{Action: action, Err: ErrABIExport, Msg: "declared as " + sig.String()}
+		}
+		return nil, nil
+	}
+	values, err := app.ABI.decodeArgs(action, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(sig.ParamTypes) {
+		return nil, &ABIError{Action: action, Err: ErrABIExport, Msg: "declared as " + sig.String()}
+	}
+
+	vmem := app.VM.VMemory()
+	params := make([]uint64, len(values))
+	for i, v := range values {
+		if sig.ParamTypes[i] != abiValueTypes[a.Inputs[i].Type] {
+			return nil, &ABIError{Action: action, Param: a.Inputs[i].Name, Err: ErrABIExport, Msg: "declared as " + sig.String()}
+		}
+		switch v := v.(type) {
+		case int32:
+			params[i] = uint64(uint32(v))
+		case int64:
+			params[i] = uint64(v)
+		case float32:
+			params[i] = uint64(math.Float32bits(v))
+		case float64:
+			params[i] = math.Float64bits(v)
+		case string:
+			params[i], err = vmem.SetBytes([]byte(v))
+		case types.Address:
+			params[i], err = vmem.SetBytes(bytes.ToLower([]byte(v.String())))
+		case *big.Int:
+			params[i], err = vmem.SetBytes([]byte(v.String()))
+		}
+		if err != nil {
+			return nil, ErrMemorySet
+		}
+	}
+	return params, nil
+}
+
+// nativeExport reports whether the native code of app runs the function at
+// fnIndex, a local function exported by app.
+func (app *APP) nativeExport(fnIndex int64) bool {
+	if app.native == nil || !app.native.HasExport() || app.Module.Function == nil {
+		return false
+	}
+	imported := len(app.Module.FunctionIndexSpace) - len(app.Module.Function.Types)
+	return fnIndex >= int64(imported)
+}
+
+// exportValue returns the result of a function of signature sig from its
+// bits, as the interpreter returns it.
+func exportValue(sig *wasm.FunctionSig, bits uint64) interface{} {
+	if len(sig.ReturnTypes) == 0 {
+		return nil
+	}
+	switch sig.ReturnTypes[0] {
+	case wasm.ValueTypeI32:
+		return uint32(bits)
+	case wasm.ValueTypeF32:
+		return math.Float32frombits(uint32(bits))
+	case wasm.ValueTypeF64:
+		return math.Float64frombits(bits)
+	default:
+		return bits
+	}
+}
+
+// exportResult returns the result ret of action as a string in the memory
+// of app, like the result of the APPEntry. Strings are returned as is.
+func (app *APP) exportResult(action string, ret interface{}) (uint64, error) {
+	var s string
+	switch v := ret.(type) {
+	case nil:
+		return 0, nil
+	case uint32:
+		a, _ := app.ABI.Action(action)
+		if a == nil || a.Output != ABIInt {
+			return uint64(v), nil
+		}
+		s = strconv.FormatInt(int64(int32(v)), 10)
+	case uint64:
+		s = strconv.FormatInt(int64(v), 10)
+	case float32:
+		s = strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		s = strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return 0, fmt.Errorf("exec: unknown result %T", ret)
+	}
+	return app.VM.VMemory().SetBytes([]byte(s))
+}
+
 // RunF execute function code based on specific fnInex.
 func (app *APP) RunF(fnIndex int64, args ...uint64) (uint64, error) {
 	if !app.IsPreRun {
@@ -0,0 +1,138 @@
+package vm
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/xunleichain/tc-wasm/mock/types"
+)
+
+const (
+	// DefaultAppCacheEntries is the default entry limit of an AppCache.
+	DefaultAppCacheEntries = 1024
+	// DefaultAppCacheBytes is the default size limit of an AppCache.
+	DefaultAppCacheBytes = 512 * 1024 * 1024
+)
+
+var (
+	// DefaultAppCache is used by engines created without a cache.
+	DefaultAppCache = NewAppCache(DefaultAppCacheEntries, DefaultAppCacheBytes)
+)
+
+// AppCacheStats holds the counters of an AppCache.
+type AppCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int
+}
+
+// AppCache is a LRU cache of parsed contracts keyed by code hash. It is
+// bounded by both a number of entries and an approximate size in bytes, and
+// is safe for concurrent use.
+type AppCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int
+	bytes      int
+	ll         *list.List
+	items      map[types.Hash]*list.Element
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type appCacheEntry struct {
+	hash types.Hash
+	app  *APP
+	size int
+}
+
+// NewAppCache returns an AppCache holding at most maxEntries contracts and
+// about maxBytes bytes, a limit <= 0 means no limit.
+func NewAppCache(maxEntries, maxBytes int) *AppCache {
+	return &AppCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      make(map[types.Hash]*list.Element),
+	}
+}
+
+// Get returns the contract cached for hash, nil if there is none.
+func (c *AppCache) Get(hash types.Hash) *APP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[hash]; ok {
+		c.hits++
+		c.ll.MoveToFront(e)
+		return e.Value.(*appCacheEntry).app
+	}
+	c.misses++
+	return nil
+}
+
+// Add caches app for hash, size is its approximate footprint in bytes, in
+// place of the contract cached for hash if any. Least recently used
+// contracts are evicted to honor the limits of the cache.
+func (c *AppCache) Add(hash types.Hash, app *APP, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	RetainNative(app)
+	if e, ok := c.items[hash]; ok {
+		entry := e.Value.(*appCacheEntry)
+		c.bytes += size - entry.size
+		DeleteNative(entry.app)
+		entry.app, entry.size = app, size
+		c.ll.MoveToFront(e)
+	} else {
+		c.items[hash] = c.ll.PushFront(&appCacheEntry{hash: hash, app: app, size: size})
+		c.bytes += size
+	}
+
+	for c.ll.Len() > 1 && ((c.maxEntries > 0 && c.ll.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes)) {
+		c.removeElement(c.ll.Back())
+		c.evictions++
+	}
+}
+
+// Remove drops the contract cached for hash.
+func (c *AppCache) Remove(hash types.Hash) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[hash]; ok {
+		c.removeElement(e)
+	}
+}
+
+// Stats returns the counters of the cache.
+func (c *AppCache) Stats() AppCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return AppCacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   c.ll.Len(),
+		Bytes:     c.bytes,
+	}
+}
+
+func (c *AppCache) removeElement(e *list.Element) {
+	entry := c.ll.Remove(e).(*appCacheEntry)
+	delete(c.items, entry.hash)
+	c.bytes -= entry.size
+	DeleteNative(entry.app)
+}
+
+// appSize estimates the footprint of app parsed from code: the module and
+// its compiled functions are counted as twice the code, plus the memory.
+func appSize(app *APP, code []byte) int {
+	return 2*len(code) + len(app.VM.VMemory().Memory)
+}
@@ -0,0 +1,90 @@
+package vm
+
+import (
+	"encoding/json"
+
+	"github.com/xunleichain/tc-wasm/mock/types"
+)
+
+// CallFrame is a node of the call tree built by CallTracer.
+type CallFrame struct {
+	From    string       `json:"from"`
+	To      string       `json:"to"`
+	Action  string       `json:"action"`
+	Args    string       `json:"args"`
+	Gas     uint64       `json:"gas"`
+	GasUsed uint64       `json:"gasUsed"`
+	Output  string       `json:"output,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Calls   []*CallFrame `json:"calls,omitempty"`
+}
+
+// CallTracer is a Tracer that records the tree of frames run by the engine,
+// the top-level frame and every nested contract call. A new top-level frame
+// starts a new tree.
+type CallTracer struct {
+	root  *CallFrame
+	stack []*CallFrame
+}
+
+// NewCallTracer returns an empty CallTracer.
+func NewCallTracer() *CallTracer {
+	return &CallTracer{}
+}
+
+// CaptureEnter implements Tracer.
+func (t *CallTracer) CaptureEnter(depth int, from types.Address, app string, action, args string, gas uint64) {
+	frame := &CallFrame{
+		From:   from.String(),
+		To:     app,
+		Action: action,
+		Args:   args,
+		Gas:    gas,
+	}
+	if depth == 0 || len(t.stack) == 0 {
+		t.root = frame
+		t.stack = append(t.stack[:0], frame)
+		return
+	}
+	if depth < len(t.stack) {
+		t.stack = t.stack[:depth]
+	}
+	parent := t.stack[len(t.stack)-1]
+	parent.Calls = append(parent.Calls, frame)
+	t.stack = append(t.stack, frame)
+}
+
+// CaptureExit implements Tracer.
+func (t *CallTracer) CaptureExit(depth int, ret uint64, output []byte, gasUsed uint64, err error) {
+	if depth >= len(t.stack) {
+		return
+	}
+	frame := t.stack[depth]
+	frame.GasUsed = gasUsed
+	frame.Output = string(output)
+	if err != nil {
+		frame.Error = err.Error()
+	}
+	t.stack = t.stack[:depth]
+}
+
+// CaptureHostCall implements Tracer.
+func (t *CallTracer) CaptureHostCall(depth int, name string, args []uint64, ret uint64, gas uint64, err error) {
+}
+
+// CaptureMemoryGrow implements Tracer.
+func (t *CallTracer) CaptureMemoryGrow(depth int, oldSize, newSize int) {}
+
+// CaptureFault implements Tracer.
+func (t *CallTracer) CaptureFault(depth int, err error) {}
+
+// Result returns the root of the last recorded call tree, nil if nothing
+// was traced.
+func (t *CallTracer) Result() *CallFrame {
+	return t.root
+}
+
+// GetResult returns the last recorded call tree as JSON.
+func (t *CallTracer) GetResult() (json.RawMessage, error) {
+	return json.Marshal(t.root)
+}
@@ -56,6 +56,7 @@ type Contract struct {
 
 	Gas   uint64
 	value *big.Int
+	token *types.Address
 
 	DelegateCall bool
 	CreateCall   bool
@@ -100,6 +101,7 @@ func (c *Contract) AsDelegate() *Contract {
 	parent := c.caller.(*Contract)
 	c.CallerAddress = parent.CallerAddress
 	c.value = parent.value
+	c.token = parent.token
 
 	return c
 }
@@ -131,6 +133,20 @@ func (c *Contract) Value() *big.Int {
 	return c.value
 }
 
+// Token returns the token in which the value of the contract is paid, ok is
+// false if it was not set and the token of the transaction applies.
+func (c *Contract) Token() (token types.Address, ok bool) {
+	if c.token == nil {
+		return types.EmptyAddress, false
+	}
+	return *c.token, true
+}
+
+// SetToken sets the token in which the value of the contract is paid.
+func (c *Contract) SetToken(token types.Address) {
+	c.token = &token
+}
+
 // SetCode sets the code to the contract
 func (c *Contract) SetCode(hash types.Hash, code []byte) {
 	c.Code = code
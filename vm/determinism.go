@@ -0,0 +1,179 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/go-interpreter/wagon/wasm"
+	"github.com/go-interpreter/wagon/wasm/leb128"
+	ops "github.com/go-interpreter/wagon/wasm/operators"
+)
+
+// DeterminismPolicy tells which constructs CheckDeterminism allows. The zero
+// value rejects all of them.
+type DeterminismPolicy struct {
+	// AllowFloats allows the f32 and f64 operators, whose results may
+	// differ between platforms on NaNs.
+	AllowFloats bool
+	// AllowStart allows a start function, which runs when the module is
+	// loaded rather than when it is called.
+	AllowStart bool
+	// AllowUnboundedMemory allows a memory declared without a maximum.
+	AllowUnboundedMemory bool
+	// AllowUnknownImports allows imports which are not registered in the
+	// EnvTable the module is checked against.
+	AllowUnknownImports bool
+}
+
+// Violation is a construct of a module rejected by a DeterminismPolicy.
+type Violation struct {
+	// Func is the index of the function in the function index space,
+	// imports included, and Offset the offset of the operator in the body of
+	// the function. Both are -1 for violations of the module itself.
+	Func   int64
+	Offset int64
+	Msg    string
+}
+
+func (v Violation) String() string {
+	if v.Func < 0 {
+		return v.Msg
+	}
+	return fmt.Sprintf("fn %d at %#x: %s", v.Func, v.Offset, v.Msg)
+}
+
+// CheckDeterminism checks code, a wasm module, against policy and the host
+// functions registered in env. It returns a *DeterminismError listing every
+// violation found, or the error of the decoder if code is malformed.
+func CheckDeterminism(code []byte, env *EnvTable, policy DeterminismPolicy) error {
+	m, err := wasm.DecodeModule(bytes.NewReader(code))
+	if err != nil {
+		return err
+	}
+
+	var violations []Violation
+	module := func(format string, a ...interface{}) {
+		violations = append(violations, Violation{Func: -1, Offset: -1, Msg: fmt.Sprintf(format, a...)})
+	}
+
+	imported := 0
+	if m.Import != nil {
+		for _, entry := range m.Import.Entries {
+			if entry.Type.Kind() == wasm.ExternalFunction {
+				imported++
+			}
+			if !policy.AllowUnknownImports && !env.hasImport(entry) {
+				module("unknown import %s.%s", entry.ModuleName, entry.FieldName)
+			}
+		}
+	}
+	if m.Start != nil && !policy.AllowStart {
+		module("start function %d", m.Start.Index)
+	}
+	if m.Memory != nil && !policy.AllowUnboundedMemory {
+		for _, entry := range m.Memory.Entries {
+			if entry.Limits.Flags&0x1 == 0 {
+				module("memory without maximum")
+			}
+		}
+	}
+
+	if m.Code != nil && !policy.AllowFloats {
+		for i, body := range m.Code.Bodies {
+			fn := int64(imported + i)
+			err := scanCode(body.Code, func(offset int64, op ops.Op) {
+				if isFloatOp(op) {
+					violations = append(violations, Violation{Func: fn, Offset: offset, Msg: "float operator " + op.Name})
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(violations) != 0 {
+		return &DeterminismError{Violations: violations}
+	}
+	return nil
+}
+
+// hasImport tells whether entry is registered in env with the same kind.
+func (env *EnvTable) hasImport(entry wasm.ImportEntry) bool {
+	im, ok := env.modules[entry.ModuleName]
+	if !ok {
+		return false
+	}
+	export, ok := im.Exports.Entries[entry.FieldName]
+	return ok && export.Kind == entry.Type.Kind()
+}
+
+func isFloatOp(op ops.Op) bool {
+	for _, t := range op.Args {
+		if t == wasm.ValueTypeF32 || t == wasm.ValueTypeF64 {
+			return true
+		}
+	}
+	return op.Returns == wasm.ValueTypeF32 || op.Returns == wasm.ValueTypeF64
+}
+
+// scanCode calls visit with the offset of each operator of code, the body of
+// a function.
+func scanCode(code []byte, visit func(offset int64, op ops.Op)) error {
+	r := bytes.NewReader(code)
+	for {
+		offset := int64(len(code) - r.Len())
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		op, err := ops.New(b)
+		if err != nil {
+			return err
+		}
+		visit(offset, op)
+
+		if err := skipImmediates(r, b); err != nil {
+			return err
+		}
+	}
+}
+
+// skipImmediates reads the immediates of the operator op from r, as
+// disasm.Disassemble does.
+func skipImmediates(r *bytes.Reader, op byte) error {
+	var err error
+	n := 0
+	switch op {
+	case ops.Block, ops.Loop, ops.If:
+		_, err = r.ReadByte()
+	case ops.F32Const:
+		_, err = io.ReadFull(r, make([]byte, 4))
+	case ops.F64Const:
+		_, err = io.ReadFull(r, make([]byte, 8))
+	case ops.I32Const:
+		_, err = leb128.ReadVarint32(r)
+	case ops.I64Const:
+		_, err = leb128.ReadVarint64(r)
+	case ops.BrTable:
+		var targets uint32
+		if targets, err = leb128.ReadVarUint32(r); err == nil {
+			n = int(targets) + 1
+		}
+	case ops.Br, ops.BrIf, ops.Call, ops.GetLocal, ops.SetLocal, ops.TeeLocal, ops.GetGlobal, ops.SetGlobal,
+		ops.CurrentMemory, ops.GrowMemory:
+		n = 1
+	case ops.CallIndirect, ops.I32Load, ops.I64Load, ops.F32Load, ops.F64Load, ops.I32Load8s, ops.I32Load8u, ops.I32Load16s, ops.I32Load16u,
+		ops.I64Load8s, ops.I64Load8u, ops.I64Load16s, ops.I64Load16u, ops.I64Load32s, ops.I64Load32u,
+		ops.I32Store, ops.I64Store, ops.F32Store, ops.F64Store, ops.I32Store8, ops.I32Store16,
+		ops.I64Store8, ops.I64Store16, ops.I64Store32:
+		n = 2
+	}
+	for ; err == nil && n > 0; n-- {
+		_, err = leb128.ReadVarUint32(r)
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package vm
+
+import (
+	"reflect"
+	"testing"
+
+	ops "github.com/go-interpreter/wagon/wasm/operators"
+)
+
+// immediates are encoded immediates of the operators which have some, with
+// multi-byte LEB128 values where the immediate is one.
+var immediates = map[byte][]byte{
+	ops.Block:         {0x40},
+	ops.Loop:          {0x7f},
+	ops.If:            {0x40},
+	ops.Br:            {0x81, 0x01},
+	ops.BrIf:          {0x81, 0x01},
+	ops.BrTable:       {0x02, 0x00, 0x81, 0x01, 0x02},
+	ops.Call:          {0xff, 0x01},
+	ops.CallIndirect:  {0x81, 0x01, 0x00},
+	ops.GetLocal:      {0x80, 0x01},
+	ops.SetLocal:      {0x80, 0x01},
+	ops.TeeLocal:      {0x80, 0x01},
+	ops.GetGlobal:     {0x80, 0x01},
+	ops.SetGlobal:     {0x80, 0x01},
+	ops.CurrentMemory: {0x00},
+	ops.GrowMemory:    {0x00},
+	ops.I32Const:      {0x80, 0x80, 0x7f},
+	ops.I64Const:      {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00},
+	ops.F32Const:      {0x00, 0x00, 0x80, 0x3f},
+	ops.F64Const:      {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf0, 0x3f},
+}
+
+func TestSkipImmediates(t *testing.T) {
+	for op := 0; op < 256; op++ {
+		if _, err := ops.New(byte(op)); err != nil {
+			continue
+		}
+		imm, ok := immediates[byte(op)]
+		if !ok && op >= int(ops.I32Load) && op <= int(ops.I64Store32) {
+			// align and offset
+			imm = []byte{0x02, 0x80, 0x01}
+		}
+
+		// the operator is followed by a nop, which must be visited next
+		code := append(append([]byte{byte(op)}, imm...), ops.Nop)
+		var offsets []int64
+		var codes []byte
+		err := scanCode(code, func(offset int64, o ops.Op) {
+			offsets = append(offsets, offset)
+			codes = append(codes, o.Code)
+		})
+		if err != nil {
+			t.Fatalf("%#x: %v", op, err)
+		}
+		if want := []int64{0, int64(1 + len(imm))}; !reflect.DeepEqual(offsets, want) {
+			t.Fatalf("%#x: offsets: wanted(%v), got(%v)", op, want, offsets)
+		}
+		if want := []byte{byte(op), ops.Nop}; !reflect.DeepEqual(codes, want) {
+			t.Fatalf("%#x: operators: wanted(%v), got(%v)", op, want, codes)
+		}
+
+		// truncated immediates are an error
+		if len(imm) != 0 {
+			if err := scanCode(code[:len(imm)], func(int64, ops.Op) {}); err == nil {
+				t.Fatalf("%#x: truncated immediates accepted", op)
+			}
+		}
+	}
+}
+
+func TestScanBrTable(t *testing.T) {
+	tests := []struct {
+		code    []byte
+		offsets []int64
+		fail    bool
+	}{
+		// no target but the default one
+		{[]byte{ops.BrTable, 0x00, 0x00, ops.Nop}, []int64{0, 3}, false},
+		// three targets and the default one
+		{[]byte{ops.BrTable, 0x03, 0x00, 0x01, 0x82, 0x01, 0x00, ops.Nop}, []int64{0, 7}, false},
+		// the count of targets is a LEB128
+		{append(append([]byte{ops.BrTable, 0x80, 0x01}, make([]byte, 129)...), ops.Nop), []int64{0, 132}, false},
+		// the default target is missing
+		{[]byte{ops.BrTable, 0x02, 0x00, 0x01}, nil, true},
+		// the count of targets is missing
+		{[]byte{ops.BrTable}, nil, true},
+	}
+	for i, tt := range tests {
+		var offsets []int64
+		err := scanCode(tt.code, func(offset int64, _ ops.Op) {
+			offsets = append(offsets, offset)
+		})
+		if (err != nil) != tt.fail {
+			t.Fatalf("case %d: wanted fail(%v), got(%v)", i, tt.fail, err)
+		}
+		if !tt.fail && !reflect.DeepEqual(offsets, tt.offsets) {
+			t.Fatalf("case %d: wanted(%v), got(%v)", i, tt.offsets, offsets)
+		}
+	}
+}
+
+func TestScanUnknownOp(t *testing.T) {
+	if err := scanCode([]byte{ops.Nop, 0xff}, func(int64, ops.Op) {}); err == nil {
+		t.Fatalf("unknown operator accepted")
+	}
+}
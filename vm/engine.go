@@ -1,51 +1,55 @@
 package vm
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
 	"runtime/debug"
-	"sync"
 
+	"github.com/go-interpreter/wagon/exec"
 	"github.com/xunleichain/tc-wasm/mock/log"
 	"github.com/xunleichain/tc-wasm/mock/types"
 )
 
-const (
-	maxFrames = 64
-)
+// ReentrancyPolicy decides whether a contract may be called again while it is
+// already on the frame stack of the engine.
+type ReentrancyPolicy int
 
-var (
-	AppCache *sync.Map
+const (
+	// ReentrancyForbidSelf rejects a contract calling itself directly, a
+	// cycle through other contracts such as A→B→A is allowed. It is the
+	// default.
+	ReentrancyForbidSelf ReentrancyPolicy = iota
+	// ReentrancyForbid rejects every call into a contract that is running.
+	ReentrancyForbid
+	// ReentrancyAllow lets any contract be entered again.
+	ReentrancyAllow
+	// ReentrancyReadOnly lets a contract be entered again by read-only
+	// frames only, e.g. those started by TC_StaticCallContract.
+	ReentrancyReadOnly
 )
 
-func init() {
-	AppCache = new(sync.Map)
-}
-
-func RemoveCache(name string) {
-	_app, ok := AppCache.Load(name)
-	if !ok {
-		return
-	}
-
-	app := _app.(*APP)
-	DeleteNative(app)
-	AppCache.Delete(name)
-}
-
 type StateDB interface {
 	GetContractCode([]byte) []byte
+	GetCodeHash(types.Address) types.Hash
 	GetContractInfo([]byte) []byte
 	SetContractInfo([]byte, []byte)
+	Snapshot() int
+	RevertToSnapshot(int)
 }
 
 type Engine struct {
 	logger       log.Logger
 	isTrace      bool
 	isZeroAddr   bool
+	readOnly     bool
+	reentrancy   ReentrancyPolicy
+	limits       Limits
+	limitsErr    error
 	State        StateDB
-	AppCache     *sync.Map
+	AppCache     *AppCache
 	Env          *EnvTable
 	AppFrames    []*APP
 	FrameIndex   int
@@ -55,17 +59,48 @@ type Engine struct {
 	Contract     *Contract
 	Ctx          interface{}
 	fee          uint64
+	tracer       Tracer
+	hostGas      uint64
+	traceMem     []int
+
+	// gasSchedule, if set, is the cost of the instructions charged to the
+	// contracts by the code NewApp injects, see Instrument.
+	gasSchedule *GasSchedule
+
+	// returnData is set by TC_SetReturnData or a revert in the running
+	// frame, output is the one of the last frame run, nil if not set.
+	// callResult is the result of the last call made by the running frame.
+	returnData []byte
+	output     []byte
+	callResult []byte
 
 	jsonCache []map[string]json.RawMessage
 }
 
-func NewEngine(c *Contract, gas uint64, db StateDB, logger log.Logger) *Engine {
+// NewEngine returns an engine running contract c with gas on db. Parsed
+// contracts are kept in cache, DefaultAppCache if it is nil, and checked
+// against limits, DefaultLimits if it is nil. If limits are invalid, the
+// engine fails to load any contract with ErrInvalidLimits.
+func NewEngine(c *Contract, gas uint64, db StateDB, logger log.Logger, cache *AppCache, limits *Limits) *Engine {
+	if cache == nil {
+		cache = DefaultAppCache
+	}
+	if limits == nil {
+		limits = &DefaultLimits
+	}
+	limitsErr := limits.check()
+	frames := limits.FrameDepth
+	if limitsErr != nil {
+		frames = 0
+	}
 	eng := &Engine{
 		logger:     logger,
+		limits:     *limits,
+		limitsErr:  limitsErr,
 		State:      db,
-		AppCache:   AppCache,
-		Env:        NewEnvTable(),
-		AppFrames:  make([]*APP, maxFrames),
+		AppCache:   cache,
+		Env:        DefaultEnvTable(),
+		AppFrames:  make([]*APP, frames),
 		FrameIndex: -1,
 		gas:        gas,
 		Contract:   c,
@@ -79,20 +114,69 @@ func (eng *Engine) EnvTable() *EnvTable {
 	return eng.Env
 }
 
+// importTable returns the table the contracts loaded by the engine import
+// from: its EnvTable, with the gas function if it has a GasSchedule.
+func (eng *Engine) importTable() *EnvTable {
+	if eng.gasSchedule != nil {
+		return eng.Env.withGas()
+	}
+	return eng.Env
+}
+
+// SetEnvTable sets the host functions exposed to the contracts run by the
+// engine, DefaultEnvTable by default. It must be called before any contract
+// is loaded.
+func (eng *Engine) SetEnvTable(env *EnvTable) {
+	eng.Env = env
+}
+
+// SetGasSchedule sets the schedule the contracts loaded by the engine are
+// instrumented with, see Instrument. If it is nil, the default, contracts are
+// charged by the interpreter and can not import the GasFuncName function. It
+// must be called before any contract is loaded.
+func (eng *Engine) SetGasSchedule(schedule *GasSchedule) {
+	eng.gasSchedule = schedule
+}
+
+// GasSchedule returns the gas schedule of the engine, nil if contracts are
+// not instrumented.
+func (eng *Engine) GasSchedule() *GasSchedule {
+	return eng.gasSchedule
+}
+
+// Limits returns the limits of the engine.
+func (eng *Engine) Limits() Limits {
+	return eng.limits
+}
+
+// cacheKey returns the AppCache key of code hashed to hash. Host functions
+// are bound, limits are checked and gas metering is injected when a contract
+// is parsed, so the key includes the EnvTable, the Limits and the
+// GasSchedule.
+func (eng *Engine) cacheKey(hash types.Hash) types.Hash {
+	if eng.Env == defaultEnvTable && eng.limits == DefaultLimits && eng.gasSchedule == nil {
+		return hash
+	}
+	var id [8]byte
+	binary.BigEndian.PutUint64(id[:], eng.Env.id)
+	if eng.gasSchedule == nil {
+		return types.Keccak256Hash(hash.Bytes(), id[:], eng.limits.key())
+	}
+	return types.Keccak256Hash(hash.Bytes(), id[:], eng.limits.key(), eng.gasSchedule.key())
+}
+
 func (eng *Engine) Logger() log.Logger {
 	return eng.logger
 }
 
+// RemoveCache drops the cached contract for the code at address name.
 func (eng *Engine) RemoveCache(name string) {
-	RemoveCache(name)
+	eng.AppCache.Remove(eng.cacheKey(eng.State.GetCodeHash(types.HexToAddress(name))))
 }
 
+// AppByName returns the cached contract for the code at address name.
 func (eng *Engine) AppByName(name string) *APP {
-	app, _ := eng.AppCache.Load(name)
-	if app != nil {
-		return app.(*APP)
-	}
-	return nil
+	return eng.AppCache.Get(eng.cacheKey(eng.State.GetCodeHash(types.HexToAddress(name))))
 }
 
 // UseGas implement Backend
@@ -119,6 +203,52 @@ func (eng *Engine) Caller() []byte {
 	return caller.Bytes()
 }
 
+// SetReadOnly switches the engine into (or out of) read-only mode. While it
+// is set, every frame run by the engine, including nested TC_CallContract
+// frames, must not modify state.
+func (eng *Engine) SetReadOnly(readOnly bool) {
+	eng.readOnly = readOnly
+}
+
+// IsReadOnly reports whether state-mutating host functions are forbidden.
+func (eng *Engine) IsReadOnly() bool {
+	return eng.readOnly
+}
+
+// SetReentrancyPolicy sets how the engine treats calls into a contract that is
+// already running, ReentrancyForbidSelf by default.
+func (eng *Engine) SetReentrancyPolicy(policy ReentrancyPolicy) {
+	eng.reentrancy = policy
+}
+
+// checkReentrancy returns ErrReentrancy if running app now would violate the
+// reentrancy policy of the engine.
+func (eng *Engine) checkReentrancy(app *APP) error {
+	switch eng.reentrancy {
+	case ReentrancyAllow:
+		return nil
+	case ReentrancyForbidSelf:
+		if eng.runningFrame != nil && eng.runningFrame.Name == app.Name {
+			return ErrReentrancy
+		}
+		return nil
+	case ReentrancyReadOnly:
+		if eng.readOnly {
+			return nil
+		}
+	}
+
+	if eng.runningFrame != nil && eng.runningFrame.Name == app.Name {
+		return ErrReentrancy
+	}
+	for i := 0; i <= eng.FrameIndex; i++ {
+		if eng.AppFrames[i].Name == app.Name {
+			return ErrReentrancy
+		}
+	}
+	return nil
+}
+
 func (eng *Engine) SetTrace(isTrace bool) {
 	eng.isTrace = isTrace
 }
@@ -135,38 +265,45 @@ func (eng *Engine) Trace(msg string, v ...interface{}) {
 	}
 }
 
+// NewApp returns a new instance of the contract at address name, code is
+// used instead of the code of name if given. Contracts are cached by code
+// hash, so a change of the code at name is picked up without invalidation.
 func (eng *Engine) NewApp(name string, code []byte, debug bool) (*APP, error) {
-	if app := eng.AppByName(name); app != nil {
-		return app.Clone(eng), nil
+	if eng.limitsErr != nil {
+		return nil, eng.limitsErr
+	}
+	var hash types.Hash
+	if len(code) != 0 {
+		hash = types.Keccak256Hash(code)
+	} else {
+		hash = eng.State.GetCodeHash(types.HexToAddress(name))
+	}
+	hash = eng.cacheKey(hash)
+	if app := eng.AppCache.Get(hash); app != nil {
+		return app.Clone(eng, name), nil
 	}
 
 	if len(code) == 0 {
-		// addr, err := strToAddress(name)
-		// if err != nil {
-		// 	return nil, err
-		// }
-		// types.HexToAddress(app.Name)
-
 		code = eng.State.GetContractCode(types.HexToAddress(name).Bytes())
 		if len(code) == 0 {
 			return nil, ErrContractNoCode
 		}
 	}
 
-	app, err := NewApp(name, code, eng, debug, eng.logger)
+	app, err := NewApp(name, code, eng, debug, eng.logger, &eng.limits)
 
 	if err != nil {
 		return nil, err
 	}
 
-	eng.AppCache.Store(name, app)
+	eng.AppCache.Add(hash, app, appSize(app, code))
 	eng.logger.Info("[Engine] NewApp ok", "app", app.String())
 
-	return app.Clone(eng), nil
+	return app.Clone(eng, name), nil
 }
 
 func (eng *Engine) PushAppFrame(app *APP) (int, error) {
-	if eng.FrameIndex >= (maxFrames - 1) {
+	if eng.FrameIndex >= (eng.limits.FrameDepth - 1) {
 		return 0, ErrOverFrame
 	}
 
@@ -199,6 +336,13 @@ func (eng *Engine) Run(app *APP, input []byte) (uint64, error) {
 }
 
 func (eng *Engine) run(app *APP, action, args string) (ret uint64, err error) {
+	depth := eng.FrameIndex + 1
+	if eng.runningFrame != nil {
+		depth++
+	}
+	running := false
+	callerData, callerResult := eng.returnData, eng.callResult
+	eng.returnData, eng.callResult = nil, nil
 	defer func() {
 		app.Close()
 		if r := recover(); r != nil {
@@ -210,6 +354,14 @@ func (eng *Engine) run(app *APP, action, args string) (ret uint64, err error) {
 				err = fmt.Errorf("exec: %v", e)
 			}
 		}
+		if err != nil {
+			err = frameError(app, depth, running, err)
+		}
+		if errors.Is(err, ErrExecutionReverted) && eng.returnData == nil {
+			// reverted by a callee, keep its reason
+			eng.returnData = eng.callResult
+		}
+		eng.output, eng.returnData, eng.callResult = eng.returnData, callerData, callerResult
 	}()
 
 	if string(action) == "Init" || string(action) == "init" {
@@ -218,9 +370,15 @@ func (eng *Engine) run(app *APP, action, args string) (ret uint64, err error) {
 		}
 	}
 
+	if err := app.validateCall(action, args); err != nil {
+		eng.logger.Debug("[Engine] abi check fail", "app", app.String(), "err", err)
+		return 0, err
+	}
+
 	if eng.runningFrame != nil {
-		if eng.runningFrame.Name == app.Name {
-			panic("Do not call itself")
+		if err := eng.checkReentrancy(app); err != nil {
+			eng.logger.Debug("[Engine] reentrancy", "frame_index", eng.FrameIndex, "app", app.String(), "policy", eng.reentrancy)
+			return 0, err
 		}
 		if _, err := eng.PushAppFrame(eng.runningFrame); err != nil {
 			return 0, err
@@ -229,13 +387,86 @@ func (eng *Engine) run(app *APP, action, args string) (ret uint64, err error) {
 
 	eng.logger.Debug("[Engine] Run begin", "frame_index", eng.FrameIndex, "app", app.String())
 	eng.runningFrame = app
+	if eng.tracer != nil {
+		eng.traceEnter(app, action, args)
+	}
+	gasUsed := eng.gasUsed
+	running = true
 	ret, err = app.Run(action, args)
+	if eng.tracer != nil {
+		eng.traceExit(app, ret, eng.gasUsed-gasUsed, err)
+	}
 	eng.runningFrame, _ = eng.PopAppFrame()
 	eng.logger.Debug("[Engine] Run end", "frame_index", eng.FrameIndex, "app", app.String(), "ret", ret, "err", err, "gas", eng.gas, "gas_used", eng.gasUsed)
 
 	return ret, err
 }
 
+// frameError returns err, the failure of app at depth, as an Error. running
+// tells whether app was started, the error of a callee is returned as is
+// with app added to its backtrace.
+func frameError(app *APP, depth int, running bool, err error) error {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Class: ClassEngine, Err: err, Address: app.Name, Depth: depth}
+		if running {
+			e.Err = trapError(err)
+			e.Class = errorClass(e.Err)
+		}
+	}
+	if running {
+		e.Backtrace = append(e.Backtrace, StackFrame{App: app.Name, Func: app.runningFunc()})
+	}
+	return e
+}
+
+// trapError returns the stable value of err, raised while a frame runs. The
+// traps of the interpreter map to the ErrTrap* values and running out of gas
+// to ErrOutOfGas, GoPanic raises these values itself.
+func trapError(err error) error {
+	switch err {
+	case exec.ErrUnreachable:
+		return ErrTrapUnreachable
+	case exec.ErrOutOfBoundsMemoryAccess:
+		return ErrTrapMemoryOutOfBounds
+	case exec.ErrSignatureMismatch:
+		return ErrTrapIndirectCallType
+	case exec.ErrUndefinedElementIndex:
+		return ErrTrapTableOutOfBounds
+	case exec.ErrDivZero:
+		return ErrTrapDivByZero
+	case exec.ErrCallStackExhausted:
+		return ErrTrapStackOverflow
+	case exec.ErrForbiddenOp:
+		return ErrTrapForbiddenOp
+	case exec.ErrOutOfGas:
+		return ErrOutOfGas
+	}
+	return err
+}
+
+// hostError returns err, the failure of the host function fn, as an Error.
+// The error of a nested frame, e.g. of TC_CallContract, is returned as is.
+func (eng *Engine) hostError(fn string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	e := &Error{Class: ClassHost, Err: err, Func: fn, Depth: eng.FrameIndex + 1}
+	if eng.runningFrame != nil {
+		e.Address = eng.runningFrame.Name
+	}
+	if trapError(err) == ErrOutOfGas {
+		e.Err = ErrOutOfGas
+	}
+	if class := errorClass(e.Err); class != ClassTrap {
+		e.Class = class
+	}
+	return e
+}
+
 // ---------------------------------------------
 type TCCallContract struct{}
 
@@ -245,7 +476,7 @@ func (t *TCCallContract) Call(index int64, ops interface{}, args []uint64) (uint
 }
 func (t *TCCallContract) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
 	eng := ops.(*Engine)
-	return gasCallContract(eng, index, args)
+	return GasCallContract(eng, index, args)
 }
 
 // char * TC_CallContract(char *app, char *action. char *arg)
@@ -281,36 +512,117 @@ func tcCallContract(eng *Engine, index int64, args []uint64) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
-	preContract := eng.Contract
 	//callContract not support transfer
-	eng.Contract = NewContractInner(preContract, AccountRef(types.HexToAddress(string(appName))), big.NewInt(0), eng.Gas())
-	eng.Contract.Input = make([]byte, len(action)+len(params)+1)
-	copy(eng.Contract.Input[0:], action)
-	copy(eng.Contract.Input[len(action):], []byte{'|'})
-	copy(eng.Contract.Input[1+len(action):], params)
+	contract := NewContractInner(eng.Contract, AccountRef(types.HexToAddress(string(appName))), big.NewInt(0), eng.Gas())
 	eng.logger.Debug("[Engine] TC_CallContract", "app", string(appName), "action", string(action), "params", string(params))
-	retPointer, err := eng.run(toFrame, string(action), string(params))
+	return eng.callFrame(runningFrame, toFrame, contract, action, params)
+}
+
+type TCCallContractWithGas struct{}
+
+func (t *TCCallContractWithGas) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tcCallContractWithGas(eng, index, args)
+}
+func (t *TCCallContractWithGas) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return GasCallContractWithGas(eng, index, args)
+}
+
+// char * TC_CallContractWithGas(char *app, char *action, char *arg, uint64_t gas)
+// The callee may spend at most gas, the unused part is given back to the
+// caller. A callee which traps, reverts or runs out of gas makes the call
+// return NULL instead of aborting the caller, see calleeFailed.
+func tcCallContractWithGas(eng *Engine, index int64, args []uint64) (uint64, error) {
+	if len(args) != 4 {
+		return 0, ErrAppInput
+	}
+
+	runningFrame, _ := eng.RunningAppFrame()
+	if runningFrame == nil {
+		return 0, ErrEmptyFrame
+	}
+
+	vmem := runningFrame.VM.VMemory()
+	appName, err := vmem.GetString(args[0])
+	if err != nil {
+		return 0, err
+	}
+	action, err := vmem.GetString(args[1])
+	if err != nil {
+		return 0, err
+	}
+	params, err := vmem.GetString(args[2])
 	if err != nil {
 		return 0, err
 	}
-	eng.Contract = preContract
 
-	if retPointer != 0 {
-		ret, err := toFrame.VM.VMemory().GetString(uint64(retPointer))
-		if err != nil {
-			return 0, err
-		}
+	toFrame, err := eng.NewApp(string(appName), nil, false)
+	if err != nil {
+		return 0, err
+	}
 
-		_ret, err := vmem.SetBytes(ret)
-		if err != nil {
-			return 0, err
-		}
-		retPointer = uint64(_ret)
+	gas := args[3]
+	if gas > eng.gas {
+		gas = eng.gas
+	}
+	left := eng.gas - gas
+
+	// The callee runs on its own counter, whatever it leaves is returned to
+	// the caller afterwards.
+	eng.gas = gas
+	contract := NewContractInner(eng.Contract, AccountRef(types.HexToAddress(string(appName))), big.NewInt(0), gas)
+	eng.logger.Debug("[Engine] TC_CallContractWithGas", "app", string(appName), "action", string(action), "params", string(params), "gas", gas)
+	retPointer, err := eng.callFrame(runningFrame, toFrame, contract, action, params)
+	eng.gas += left
+	if calleeFailed(err) {
+		eng.logger.Debug("[Engine] TC_CallContractWithGas fail", "app", string(appName), "err", err, "gas", eng.gas)
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
 	}
 
 	return retPointer, nil
 }
 
+type TCStaticCallContract struct{}
+
+func (t *TCStaticCallContract) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tcStaticCallContract(eng, index, args)
+}
+func (t *TCStaticCallContract) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return GasCallContract(eng, index, args)
+}
+
+// char * TC_StaticCallContract(char *app, char *action. char *arg)
+// Same as TC_CallContract, but the callee and its own sub-calls run in
+// read-only mode.
+func tcStaticCallContract(eng *Engine, index int64, args []uint64) (uint64, error) {
+	if !eng.readOnly {
+		eng.readOnly = true
+		defer func() { eng.readOnly = false }()
+	}
+	return tcCallContract(eng, index, args)
+}
+
+// calleeFailed tells whether err, returned by a nested call, is a failure of
+// the callee itself: a trap, a revert or running out of gas. The errors of
+// the engine, e.g. a rejected call or a write in read-only mode, are not.
+func calleeFailed(err error) bool {
+	var e *Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	switch e.Class {
+	case ClassTrap, ClassGas, ClassRevert:
+		return true
+	}
+	return false
+}
+
 type TCDelegateCallContract struct{}
 
 func (t *TCDelegateCallContract) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
@@ -355,35 +667,173 @@ func tcDelegateCallContract(eng *Engine, index int64, args []uint64) (uint64, er
 	if err != nil {
 		return 0, err
 	}
-	preContract := eng.Contract
-	eng.Contract = NewContractInner(preContract, AccountRef(preContract.Address()), nil, eng.Gas()).AsDelegate()
-	eng.Contract.Input = make([]byte, len(action)+len(params)+1)
-	copy(eng.Contract.Input[0:], action)
-	copy(eng.Contract.Input[len(action):], []byte{'|'})
-	copy(eng.Contract.Input[1+len(action):], params)
+	contract := NewContractInner(eng.Contract, AccountRef(eng.Contract.Address()), nil, eng.Gas()).AsDelegate()
 	eng.logger.Debug("[Engine] TC_DelegateCallContract", "app", string(appName), "action", string(action), "params", string(params))
-	retPointer, err := eng.run(toFrame, string(action), string(params))
+	return eng.callFrame(runningFrame, toFrame, contract, action, params)
+}
+
+type TCTryCallContract struct{}
+
+func (t *TCTryCallContract) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return tcTryCallContract(eng, index, args)
+}
+func (t *TCTryCallContract) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng := ops.(*Engine)
+	return GasCallContract(eng, index, args)
+}
+
+// int TC_TryCallContract(char *app, char *action. char *arg)
+// Same as TC_CallContract, but returns 0 instead of failing if the callee
+// reverts, 1 otherwise. Its result or revert reason is read with
+// TC_ReturnDataSize and TC_ReturnDataCopy.
+func tcTryCallContract(eng *Engine, index int64, args []uint64) (uint64, error) {
+	if len(args) != 3 {
+		return 0, ErrAppInput
+	}
+
+	runningFrame, _ := eng.RunningAppFrame()
+	if runningFrame == nil {
+		return 0, ErrEmptyFrame
+	}
+
+	vmem := runningFrame.VM.VMemory()
+	appName, err := vmem.GetString(args[0])
+	if err != nil {
+		return 0, err
+	}
+	action, err := vmem.GetString(args[1])
+	if err != nil {
+		return 0, err
+	}
+	params, err := vmem.GetString(args[2])
 	if err != nil {
 		return 0, err
 	}
-	eng.Contract = preContract
 
-	if retPointer != 0 {
-		ret, err := toFrame.VM.VMemory().GetString(uint64(retPointer))
-		if err != nil {
-			return 0, err
-		}
+	toFrame, err := eng.NewApp(string(appName), nil, false)
+	if err != nil {
+		return 0, err
+	}
+	contract := NewContractInner(eng.Contract, AccountRef(types.HexToAddress(string(appName))), big.NewInt(0), eng.Gas())
+	eng.logger.Debug("[Engine] TC_TryCallContract", "app", string(appName), "action", string(action), "params", string(params))
+	_, err = eng.callFrameData(toFrame, contract, action, params)
+	switch {
+	case err == nil:
+		return 1, nil
+	case errors.Is(err, ErrExecutionReverted):
+		return 0, nil
+	}
+	return 0, err
+}
 
-		_ret, err := vmem.SetBytes(ret)
-		if err != nil {
-			return 0, err
-		}
-		retPointer = uint64(_ret)
+// CallContract runs action of the contract appName as a nested call of the
+// running frame, the callee sees value of token as its message value. The
+// caller is responsible for moving value to the callee beforehand.
+func (eng *Engine) CallContract(appName string, action, params []byte, value *big.Int, token types.Address) (uint64, error) {
+	runningFrame, _ := eng.RunningAppFrame()
+	if runningFrame == nil {
+		return 0, ErrEmptyFrame
 	}
 
+	toFrame, err := eng.NewApp(appName, nil, false)
+	if err != nil {
+		return 0, err
+	}
+	contract := NewContractInner(eng.Contract, AccountRef(types.HexToAddress(appName)), value, eng.Gas())
+	contract.SetToken(token)
+	eng.logger.Debug("[Engine] CallContract", "app", appName, "action", string(action), "params", string(params), "value", value, "token", token.String())
+	return eng.callFrame(runningFrame, toFrame, contract, action, params)
+}
+
+// callFrame runs toFrame as a nested call of caller under contract. State
+// changes made by toFrame are reverted if it fails, and the caller's contract
+// is restored in any case. The result of toFrame is copied into the memory of
+// caller and the new pointer is returned.
+func (eng *Engine) callFrame(caller, toFrame *APP, contract *Contract, action, params []byte) (uint64, error) {
+	ret, snapshot, err := eng.runFrame(toFrame, contract, action, params)
+	if err != nil || ret == nil {
+		return 0, err
+	}
+
+	retPointer, err := caller.VM.VMemory().SetBytes(ret)
+	if err != nil {
+		eng.State.RevertToSnapshot(snapshot)
+		return 0, err
+	}
 	return retPointer, nil
 }
 
+// callFrameData is like callFrame, but returns the result of toFrame, see
+// Output, nil if it returned NULL.
+func (eng *Engine) callFrameData(toFrame *APP, contract *Contract, action, params []byte) ([]byte, error) {
+	ret, _, err := eng.runFrame(toFrame, contract, action, params)
+	return ret, err
+}
+
+// runFrame runs the call of callFrameData, and returns the snapshot taken
+// before it, for the caller to revert the call afterwards.
+func (eng *Engine) runFrame(toFrame *APP, contract *Contract, action, params []byte) ([]byte, int, error) {
+	contract.Input = make([]byte, len(action)+len(params)+1)
+	copy(contract.Input[0:], action)
+	copy(contract.Input[len(action):], []byte{'|'})
+	copy(contract.Input[1+len(action):], params)
+
+	preContract := eng.Contract
+	eng.Contract = contract
+	defer func() { eng.Contract = preContract }()
+
+	snapshot := eng.State.Snapshot()
+	retPointer, err := eng.run(toFrame, string(action), string(params))
+	eng.callResult = nil
+	if err != nil {
+		eng.State.RevertToSnapshot(snapshot)
+		if errors.Is(err, ErrExecutionReverted) {
+			eng.callResult = eng.output
+		}
+		return nil, snapshot, err
+	}
+	if retPointer == 0 && eng.output == nil {
+		return nil, snapshot, nil
+	}
+
+	ret, err := eng.Output(toFrame, retPointer)
+	if err != nil {
+		eng.State.RevertToSnapshot(snapshot)
+		return nil, snapshot, err
+	}
+	eng.callResult = ret
+	return ret, snapshot, nil
+}
+
+// SetReturnData sets the result of the running frame to data, returned to the
+// caller instead of the string at the pointer returned by the frame.
+func (eng *Engine) SetReturnData(data []byte) {
+	eng.returnData = make([]byte, len(data))
+	copy(eng.returnData, data)
+}
+
+// RevertData returns the reason given by the last frame run, when it failed
+// with ErrExecutionReverted.
+func (eng *Engine) RevertData() []byte {
+	return eng.output
+}
+
+// revert makes the running frame revert with reason.
+func (eng *Engine) revert(reason []byte) error {
+	eng.SetReturnData(reason)
+	return ErrExecutionReverted
+}
+
+// Output returns the result of the last run of app, which returned ret: the
+// data given to TC_SetReturnData, or else the string at ret.
+func (eng *Engine) Output(app *APP, ret uint64) ([]byte, error) {
+	if eng.output != nil {
+		return eng.output, nil
+	}
+	return app.VM.VMemory().GetString(ret)
+}
+
 func (e *Engine) AddFee(fee uint64) {
 	e.fee += fee
 }
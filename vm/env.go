@@ -2,6 +2,9 @@ package vm
 
 import (
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/go-interpreter/wagon/wasm"
 )
@@ -11,143 +14,436 @@ type EnvFunc interface {
 	Gas(index int64, ops interface{}, args []uint64) (uint64, error)
 }
 
+// EnvModuleName is the import module name of the functions of an EnvTable
+// which are not registered under another one.
+const EnvModuleName = "env"
+
 // EnvTable stand for env's info which we will register for wasm module before it run.
+//
+// Its embedded import module holds the "env" functions, modules added by
+// RegisterModule are resolved under their own names. Contracts are parsed
+// against the table of the engine loading them, so a table must not be
+// changed once it is in use.
 type EnvTable struct {
+	*importModule
+	id      uint64
+	modules map[string]*importModule
+	// version counts the changes of the table, gas is built from the table
+	// at gasVersion.
+	version    uint64
+	gasMu      sync.Mutex
+	gas        *EnvTable
+	gasVersion uint64
+}
+
+// importModule is the wasm module resolving the imports from one module name.
+type importModule struct {
+	name            string
 	Exports         wasm.SectionExports
 	Module          wasm.Module
 	importFuncCnt   uint32
 	importGlobalCnt uint32
 }
 
-var (
-	gEnvTable *EnvTable
-)
-
-func init() {
-	env := EnvTable{
+func newImportModule(name string) *importModule {
+	m := &importModule{
+		name: name,
 		Exports: wasm.SectionExports{
 			Entries: make(map[string]wasm.ExportEntry),
 			Names:   make([]string, 0),
 		},
 	}
-	env.Module = wasm.Module{
-		Export:             &env.Exports,
+	m.Module = wasm.Module{
+		Export:             &m.Exports,
 		FunctionIndexSpace: make([]wasm.Function, 0),
 		GlobalIndexSpace:   make([]wasm.GlobalEntry, 0),
 	}
+	return m
+}
+
+var (
+	// ContractModule holds the host functions dealing with the running
+	// contract: nested calls, message data, assertions and reverts.
+	ContractModule = NewHostModule("contract")
+	// LibcModule holds the memory and string functions of the C runtime.
+	LibcModule = NewHostModule("libc")
+	// BigIntModule holds the big integer arithmetic functions.
+	BigIntModule = NewHostModule("bigint")
+	// CryptoModule holds the hash functions.
+	CryptoModule = NewHostModule("crypto")
+	// JSONModule holds the json parsing and building functions.
+	JSONModule = NewHostModule("json")
 
-	gEnvTable = &env
-
-	gEnvTable.RegisterFunc("TC_CallContract", new(TCCallContract))
-	gEnvTable.RegisterFunc("TC_DelegateCallContract", new(TCDelegateCallContract))
-
-	gEnvTable.RegisterFunc("TC_BigIntAdd", new(TCBigIntAdd))
-	gEnvTable.RegisterFunc("TC_BigIntSub", new(TCBigIntSub))
-	gEnvTable.RegisterFunc("TC_BigIntMul", new(TCBigIntMul))
-	gEnvTable.RegisterFunc("TC_BigIntDiv", new(TCBigIntDiv))
-	gEnvTable.RegisterFunc("TC_BigIntMod", new(TCBigIntMod))
-	gEnvTable.RegisterFunc("TC_BigIntCmp", new(TCBigIntCmp))
-	gEnvTable.RegisterFunc("TC_BigIntToInt64", new(TCBigIntToInt64))
-
-	gEnvTable.RegisterFunc("exit", new(TCExit))
-	gEnvTable.RegisterFunc("abort", new(TCAbort))
-	gEnvTable.RegisterFunc("malloc", new(TCMalloc))
-	gEnvTable.RegisterFunc("calloc", new(TCCalloc))
-	gEnvTable.RegisterFunc("realloc", new(TCRealloc))
-	gEnvTable.RegisterFunc("prints_l", new(TCPrintsl))
-	gEnvTable.RegisterFunc("free", new(TCFree))
-	gEnvTable.RegisterFunc("memcpy", new(TCMemcpy))
-	gEnvTable.RegisterFunc("memset", new(TCMemset))
-	gEnvTable.RegisterFunc("memmove", new(TCMemmove))
-	gEnvTable.RegisterFunc("memcmp", new(TCMemcmp))
-	gEnvTable.RegisterFunc("strcmp", new(TCStrcmp))
-	gEnvTable.RegisterFunc("strcpy", new(TCStrcpy))
-	gEnvTable.RegisterFunc("strlen", new(TCStrlen))
-	gEnvTable.RegisterFunc("strconcat", new(TCStrconcat))
-	gEnvTable.RegisterFunc("atoi", new(TCAtoi))
-	gEnvTable.RegisterFunc("atoi64", new(TCAtoi64))
-	//	gEnvTable.RegisterFunc("atof32", new(TCAtof32))
-	//	gEnvTable.RegisterFunc("atof64", new(TCAtof64))
-	gEnvTable.RegisterFunc("itoa", new(TCItoa))
-	gEnvTable.RegisterFunc("i64toa", new(TCI64toa))
-
-	gEnvTable.RegisterFunc("TC_GetMsgData", new(TCGetMsgData))
-	gEnvTable.RegisterFunc("TC_GetMsgGas", new(TCGetMsgGas))
-	gEnvTable.RegisterFunc("TC_GetMsgSender", new(TCGetMsgSender))
-	gEnvTable.RegisterFunc("TC_GetMsgSign", new(TCGetMsgSign))
-	gEnvTable.RegisterFunc("TC_Assert", new(TCAssert))
-	gEnvTable.RegisterFunc("TC_Require", new(TCRequire))
-	gEnvTable.RegisterFunc("TC_GasLeft", new(TCGasLeft))
-	gEnvTable.RegisterFunc("TC_RequireWithMsg", new(TCRequireWithMsg))
-	gEnvTable.RegisterFunc("TC_Revert", new(TCRevert))
-	gEnvTable.RegisterFunc("TC_RevertWithMsg", new(TCRevertWithMsg))
-	gEnvTable.RegisterFunc("TC_IsHexAddress", new(TCIsHexAddress))
-	gEnvTable.RegisterFunc("TC_Payable", new(TCPayable))
-
-	gEnvTable.RegisterFunc("TC_Prints", new(TCPrints))
-	gEnvTable.RegisterFunc("TC_GetSelfAddress", new(TCGetSelfAddress))
-	gEnvTable.RegisterFunc("TC_Ripemd160", new(TCRipemd160))
-	gEnvTable.RegisterFunc("TC_Sha256", new(TCSha256))
-	gEnvTable.RegisterFunc("TC_Keccak256", new(TCKeccak256))
+	defaultEnvTable *EnvTable
+	envTableID      uint64
+)
+
+func init() {
+	ContractModule.Register("TC_CallContract", "(iii)i", new(TCCallContract))
+	ContractModule.Register("TC_DelegateCallContract", "(iii)i", new(TCDelegateCallContract))
+	ContractModule.Register("TC_CallContractWithGas", "(iiiI)i", new(TCCallContractWithGas))
+	ContractModule.Register("TC_StaticCallContract", "(iii)i", new(TCStaticCallContract))
+	ContractModule.Register("TC_TryCallContract", "(iii)i", new(TCTryCallContract))
+
+	BigIntModule.Register("TC_BigIntAdd", "(ii)i", new(TCBigIntAdd))
+	BigIntModule.Register("TC_BigIntSub", "(ii)i", new(TCBigIntSub))
+	BigIntModule.Register("TC_BigIntMul", "(ii)i", new(TCBigIntMul))
+	BigIntModule.Register("TC_BigIntDiv", "(ii)i", new(TCBigIntDiv))
+	BigIntModule.Register("TC_BigIntMod", "(ii)i", new(TCBigIntMod))
+	BigIntModule.Register("TC_BigIntCmp", "(ii)i", new(TCBigIntCmp))
+	BigIntModule.Register("TC_BigIntToInt64", "(i)I", new(TCBigIntToInt64))
+
+	LibcModule.Register("exit", "(i)", new(TCExit))
+	LibcModule.Register("abort", "()", new(TCAbort))
+	LibcModule.Register("malloc", "(i)i", new(TCMalloc))
+	LibcModule.Register("calloc", "(ii)i", new(TCCalloc))
+	LibcModule.Register("realloc", "(ii)i", new(TCRealloc))
+	LibcModule.Register("prints_l", "(ii)", new(TCPrintsl))
+	LibcModule.Register("free", "(i)", new(TCFree))
+	LibcModule.Register("memcpy", "(iii)i", new(TCMemcpy))
+	LibcModule.Register("memset", "(iii)i", new(TCMemset))
+	LibcModule.Register("memmove", "(iii)i", new(TCMemmove))
+	LibcModule.Register("memcmp", "(iii)i", new(TCMemcmp))
+	LibcModule.Register("strcmp", "(ii)i", new(TCStrcmp))
+	LibcModule.Register("strcpy", "(ii)i", new(TCStrcpy))
+	LibcModule.Register("strlen", "(i)i", new(TCStrlen))
+	LibcModule.Register("strconcat", "(ii)i", new(TCStrconcat))
+	LibcModule.Register("atoi", "(i)i", new(TCAtoi))
+	LibcModule.Register("atoi64", "(i)I", new(TCAtoi64))
+	//	LibcModule.Register("atof32", "(i)f", new(TCAtof32))
+	//	LibcModule.Register("atof64", "(i)F", new(TCAtof64))
+	LibcModule.Register("itoa", "(i)i", new(TCItoa))
+	LibcModule.Register("i64toa", "(Ii)i", new(TCI64toa))
+
+	ContractModule.Register("TC_GetMsgData", "()i", new(TCGetMsgData))
+	ContractModule.Register("TC_GetMsgGas", "()I", new(TCGetMsgGas))
+	ContractModule.Register("TC_GetMsgSender", "()i", new(TCGetMsgSender))
+	ContractModule.Register("TC_GetMsgSign", "()i", new(TCGetMsgSign))
+	ContractModule.Register("TC_Assert", "(i)", new(TCAssert))
+	ContractModule.Register("TC_Require", "(i)", new(TCRequire))
+	ContractModule.Register("TC_GasLeft", "()I", new(TCGasLeft))
+	ContractModule.Register("TC_RequireWithMsg", "(ii)", new(TCRequireWithMsg))
+	ContractModule.Register("TC_Revert", "()", new(TCRevert))
+	ContractModule.Register("TC_RevertWithMsg", "(i)", new(TCRevertWithMsg))
+	ContractModule.Register("TC_IsHexAddress", "(i)i", new(TCIsHexAddress))
+	ContractModule.Register("TC_Payable", "(i)", new(TCPayable))
+	ContractModule.Register("TC_Prints", "(i)", new(TCPrints))
+	ContractModule.Register("TC_GetSelfAddress", "()i", new(TCGetSelfAddress))
+	ContractModule.Register("TC_SetReturnData", "(ii)", new(TCSetReturnData))
+	ContractModule.Register("TC_ReturnDataSize", "()i", new(TCReturnDataSize))
+	ContractModule.Register("TC_ReturnDataCopy", "(iii)", new(TCReturnDataCopy))
+
+	CryptoModule.Register("TC_Ripemd160", "(i)i", new(TCRipemd160))
+	CryptoModule.Register("TC_Sha256", "(i)i", new(TCSha256))
+	CryptoModule.Register("TC_Keccak256", "(i)i", new(TCKeccak256))
+
+	// tc2 api, see api2.go
+	ContractModule.Register("tc2_action", "(ii)i", new(TC2Action))
+	ContractModule.Register("tc2_args", "(ii)i", new(TC2Args))
+	ContractModule.Register("tc2_sender", "(i)", new(TC2Sender))
+	ContractModule.Register("tc2_self_address", "(i)", new(TC2SelfAddress))
+	ContractModule.Register("tc2_call_contract", "(iiiiiii)i", new(TC2CallContract))
+	ContractModule.Register("tc2_require", "(iii)", new(TC2Require))
+	ContractModule.Register("tc2_revert", "(ii)", new(TC2Revert))
+	ContractModule.Register("tc2_print", "(ii)", new(TC2Print))
+	CryptoModule.Register("tc2_keccak256", "(iii)", new(TC2Keccak256))
+	CryptoModule.Register("tc2_sha256", "(iii)", new(TC2Sha256))
+	CryptoModule.Register("tc2_ripemd160", "(iii)", new(TC2Ripemd160))
 
 	// go json api (optional)
-	gEnvTable.RegisterFunc("TC_JsonParse", new(TCJSONParse))
-	gEnvTable.RegisterFunc("TC_JsonGetInt", new(TCJSONGetInt))
-	gEnvTable.RegisterFunc("TC_JsonGetInt64", new(TCJSONGetInt64))
-	gEnvTable.RegisterFunc("TC_JsonGetString", new(TCJSONGetString))
-	gEnvTable.RegisterFunc("TC_JsonGetAddress", new(TCJSONGetAddress))
-	gEnvTable.RegisterFunc("TC_JsonGetBigInt", new(TCJSONGetBigInt))
-	gEnvTable.RegisterFunc("TC_JsonGetFloat", new(TCJSONGetFloat))
-	gEnvTable.RegisterFunc("TC_JsonGetDouble", new(TCJSONGetDouble))
-	gEnvTable.RegisterFunc("TC_JsonGetObject", new(TCJSONGetObject))
-	gEnvTable.RegisterFunc("TC_JsonNewObject", new(TCJSONNewObject))
-	gEnvTable.RegisterFunc("TC_JsonPutInt", new(TCJSONPutInt))
-	gEnvTable.RegisterFunc("TC_JsonPutInt64", new(TCJSONPutInt64))
-	gEnvTable.RegisterFunc("TC_JsonPutString", new(TCJSONPutString))
-	gEnvTable.RegisterFunc("TC_JsonPutAddress", new(TCJSONPutAddress))
-	gEnvTable.RegisterFunc("TC_JsonPutBigInt", new(TCJSONPutBigInt))
-	gEnvTable.RegisterFunc("TC_JsonPutFloat", new(TCJSONPutFloat))
-	gEnvTable.RegisterFunc("TC_JsonPutDouble", new(TCJSONPutDouble))
-	gEnvTable.RegisterFunc("TC_JsonPutObject", new(TCJSONPutObject))
-	gEnvTable.RegisterFunc("TC_JsonToString", new(TCJSONToString))
-}
-
-// NewEnvTable new EnvTable
-func NewEnvTable() *EnvTable {
-	return gEnvTable
+	JSONModule.Register("TC_JsonParse", "(i)i", new(TCJSONParse))
+	JSONModule.Register("TC_JsonGetInt", "(ii)i", new(TCJSONGetInt))
+	JSONModule.Register("TC_JsonGetInt64", "(ii)I", new(TCJSONGetInt64))
+	JSONModule.Register("TC_JsonGetString", "(ii)i", new(TCJSONGetString))
+	JSONModule.Register("TC_JsonGetAddress", "(ii)i", new(TCJSONGetAddress))
+	JSONModule.Register("TC_JsonGetBigInt", "(ii)i", new(TCJSONGetBigInt))
+	JSONModule.Register("TC_JsonGetFloat", "(ii)f", new(TCJSONGetFloat))
+	JSONModule.Register("TC_JsonGetDouble", "(ii)F", new(TCJSONGetDouble))
+	JSONModule.Register("TC_JsonGetObject", "(ii)i", new(TCJSONGetObject))
+	JSONModule.Register("TC_JsonNewObject", "()i", new(TCJSONNewObject))
+	JSONModule.Register("TC_JsonPutInt", "(iii)", new(TCJSONPutInt))
+	JSONModule.Register("TC_JsonPutInt64", "(iiI)", new(TCJSONPutInt64))
+	JSONModule.Register("TC_JsonPutString", "(iii)", new(TCJSONPutString))
+	JSONModule.Register("TC_JsonPutAddress", "(iii)", new(TCJSONPutAddress))
+	JSONModule.Register("TC_JsonPutBigInt", "(iii)", new(TCJSONPutBigInt))
+	JSONModule.Register("TC_JsonPutFloat", "(iif)", new(TCJSONPutFloat))
+	JSONModule.Register("TC_JsonPutDouble", "(iiF)", new(TCJSONPutDouble))
+	JSONModule.Register("TC_JsonPutObject", "(iii)", new(TCJSONPutObject))
+	JSONModule.Register("TC_JsonToString", "(i)i", new(TCJSONToString))
+
+	defaultEnvTable = NewEnvTable(BaseModules()...)
+}
+
+// HostModule is a named set of host functions. Modules are composed into an
+// EnvTable, so that engines can expose different host APIs.
+type HostModule struct {
+	Name  string
+	names []string
+	funcs map[string]hostModuleFunc
+}
+
+type hostModuleFunc struct {
+	fn  EnvFunc
+	sig wasm.FunctionSig
+}
+
+// NewHostModule returns an empty HostModule.
+func NewHostModule(name string) *HostModule {
+	return &HostModule{
+		Name:  name,
+		funcs: make(map[string]hostModuleFunc),
+	}
+}
+
+// Register adds fn to the module as name, replacing any function of the same
+// name. Contracts importing name must declare it with signature sig, see
+// ParseSig. It panics if sig is malformed.
+func (m *HostModule) Register(name string, sig string, fn EnvFunc) {
+	fsig, err := ParseSig(sig)
+	if err != nil {
+		panic(fmt.Sprintf("host function %s: %s", name, err))
+	}
+	if _, exist := m.funcs[name]; !exist {
+		m.names = append(m.names, name)
+	}
+	m.funcs[name] = hostModuleFunc{fn: fn, sig: fsig}
+}
+
+// ParseSig parses the signature of a host function written as its parameter
+// types in parentheses followed by its result type, if any. Types are i, I, f
+// and F for i32, i64, f32 and f64, e.g. "(iI)i" for a function taking an i32
+// and an i64 and returning an i32.
+func ParseSig(sig string) (wasm.FunctionSig, error) {
+	fsig := wasm.FunctionSig{Form: wasm.TypeFunc}
+	end := strings.IndexByte(sig, ')')
+	if len(sig) < 2 || sig[0] != '(' || end < 0 || len(sig) > end+2 {
+		return fsig, fmt.Errorf("invalid signature %q", sig)
+	}
+	for _, c := range sig[1:end] {
+		t, ok := sigTypes[c]
+		if !ok {
+			return fsig, fmt.Errorf("invalid type %q in signature %q", c, sig)
+		}
+		fsig.ParamTypes = append(fsig.ParamTypes, t)
+	}
+	if len(sig) == end+2 {
+		t, ok := sigTypes[rune(sig[end+1])]
+		if !ok {
+			return fsig, fmt.Errorf("invalid type %q in signature %q", sig[end+1], sig)
+		}
+		fsig.ReturnTypes = []wasm.ValueType{t}
+	}
+	return fsig, nil
+}
+
+var sigTypes = map[rune]wasm.ValueType{
+	'i': wasm.ValueTypeI32,
+	'I': wasm.ValueTypeI64,
+	'f': wasm.ValueTypeF32,
+	'F': wasm.ValueTypeF64,
+}
+
+// Names returns the names of the functions of the module in registration order.
+func (m *HostModule) Names() []string {
+	return append([]string(nil), m.names...)
+}
+
+// BaseModules returns the modules every chain builds on: contract, libc,
+// bigint, crypto and json.
+func BaseModules() []*HostModule {
+	return []*HostModule{ContractModule, LibcModule, BigIntModule, CryptoModule, JSONModule}
+}
+
+// DefaultEnvTable returns the table composed of BaseModules, used by engines
+// which are not given one.
+func DefaultEnvTable() *EnvTable {
+	return defaultEnvTable
+}
+
+// NewEnvTable returns a new EnvTable holding the functions of mods under the
+// "env" import module. A function registered by a later module replaces the
+// one of the same name from an earlier module.
+func NewEnvTable(mods ...*HostModule) *EnvTable {
+	env := &EnvTable{
+		importModule: newImportModule(EnvModuleName),
+		id:           atomic.AddUint64(&envTableID, 1),
+		modules:      make(map[string]*importModule),
+	}
+	env.modules[EnvModuleName] = env.importModule
+	env.RegisterModule(EnvModuleName, mods...)
+	return env
+}
+
+// withGas returns env with the GasFuncName function of instrumented contracts
+// added to its "env" module, built again if env changed since. Only engines
+// with a GasSchedule resolve imports against it, other contracts can not
+// import the function.
+func (env *EnvTable) withGas() *EnvTable {
+	env.gasMu.Lock()
+	defer env.gasMu.Unlock()
+	if env.gas == nil || env.gasVersion != env.version {
+		gas := &EnvTable{
+			importModule: env.importModule.clone(),
+			id:           env.id,
+			modules:      make(map[string]*importModule, len(env.modules)),
+		}
+		for name, im := range env.modules {
+			gas.modules[name] = im
+		}
+		gas.modules[EnvModuleName] = gas.importModule
+		gas.RegisterFunc(GasFuncName, "(I)", new(TCGas))
+		env.gas, env.gasVersion = gas, env.version
+	}
+	return env.gas
+}
+
+// RegisterModule adds the functions of mods to the import module named module,
+// e.g. "wasi_snapshot_preview1", creating it if needed.
+func (env *EnvTable) RegisterModule(module string, mods ...*HostModule) {
+	env.version++
+	im, ok := env.modules[module]
+	if !ok {
+		im = newImportModule(module)
+		env.modules[module] = im
+	}
+	for _, m := range mods {
+		for _, name := range m.names {
+			f := m.funcs[name]
+			im.registerFunc(name, f.fn, f.sig)
+		}
+	}
+}
+
+// clone returns a copy of im to which functions can be added without
+// changing im.
+func (im *importModule) clone() *importModule {
+	c := &importModule{
+		name: im.name,
+		Exports: wasm.SectionExports{
+			Entries: make(map[string]wasm.ExportEntry, len(im.Exports.Entries)),
+			Names:   append([]string(nil), im.Exports.Names...),
+		},
+		importFuncCnt:   im.importFuncCnt,
+		importGlobalCnt: im.importGlobalCnt,
+	}
+	for name, entry := range im.Exports.Entries {
+		c.Exports.Entries[name] = entry
+	}
+	c.Module = im.Module
+	c.Module.Export = &c.Exports
+	c.Module.FunctionIndexSpace = append([]wasm.Function(nil), im.Module.FunctionIndexSpace...)
+	c.Module.GlobalIndexSpace = append([]wasm.GlobalEntry(nil), im.Module.GlobalIndexSpace...)
+	return c
 }
 
 func (env *EnvTable) resolveImport(name string) (*wasm.Module, error) {
-	if name != "env" {
-		panic(fmt.Sprintf("invalid name: %s", name))
+	im, ok := env.modules[name]
+	if !ok {
+		return nil, &ImportError{Module: name, Err: ErrImportModule}
 	}
-	return &env.Module, nil
+
+	// wagon writes the signature and the module of an imported function into
+	// the resolved module, so each module being loaded gets its own copy.
+	m := im.Module
+	m.FunctionIndexSpace = make([]wasm.Function, len(im.Module.FunctionIndexSpace))
+	for i, fn := range im.Module.FunctionIndexSpace {
+		body := *fn.Body
+		fn.Body = &body
+		m.FunctionIndexSpace[i] = fn
+	}
+	return &m, nil
+}
+
+// checkImports returns an *ImportError if a function imported by m is not
+// declared with the signature registered for it. wagon only checks that an
+// import exists.
+func (env *EnvTable) checkImports(m *wasm.Module) error {
+	if m.Import == nil {
+		return nil
+	}
+	for _, entry := range m.Import.Entries {
+		fi, ok := entry.Type.(wasm.FuncImport)
+		if !ok {
+			continue
+		}
+		im, ok := env.modules[entry.ModuleName]
+		if !ok {
+			return &ImportError{Module: entry.ModuleName, Field: entry.FieldName, Err: ErrImportModule}
+		}
+		export, ok := im.Exports.Entries[entry.FieldName]
+		if !ok || export.Kind != wasm.ExternalFunction {
+			return &ImportError{Module: entry.ModuleName, Field: entry.FieldName, Err: ErrImportFunc}
+		}
+		want := im.Module.FunctionIndexSpace[export.Index].Sig
+		if int(fi.Type) >= len(m.Types.Entries) {
+			return &ImportError{Module: entry.ModuleName, Field: entry.FieldName, Err: ErrImportSignature, Want: want}
+		}
+		if got := &m.Types.Entries[fi.Type]; !sameSig(want, got) {
+			return &ImportError{Module: entry.ModuleName, Field: entry.FieldName, Err: ErrImportSignature, Want: want, Got: got}
+		}
+	}
+	return nil
 }
 
-// RegisterFunc Register env function for wasm module
-func (env *EnvTable) RegisterFunc(name string, fn EnvFunc) {
-	if entry, exist := env.Exports.Entries[name]; exist {
-		env.Module.FunctionIndexSpace[entry.Index].Host = fn
+func sameSig(a, b *wasm.FunctionSig) bool {
+	if len(a.ParamTypes) != len(b.ParamTypes) || len(a.ReturnTypes) != len(b.ReturnTypes) {
+		return false
+	}
+	for i, t := range a.ParamTypes {
+		if b.ParamTypes[i] != t {
+			return false
+		}
+	}
+	for i, t := range a.ReturnTypes {
+		if b.ReturnTypes[i] != t {
+			return false
+		}
+	}
+	return true
+}
+
+// RegisterFunc Register env function for wasm module, sig is its signature,
+// see ParseSig. It panics if sig is malformed.
+func (env *EnvTable) RegisterFunc(name string, sig string, fn EnvFunc) {
+	fsig, err := ParseSig(sig)
+	if err != nil {
+		panic(fmt.Sprintf("host function %s: %s", name, err))
+	}
+	env.version++
+	env.registerFunc(name, fn, fsig)
+}
+
+func (im *importModule) registerFunc(name string, fn EnvFunc, sig wasm.FunctionSig) {
+	// Native code finds host functions by name, see GetFuncByName.
+	fullName := name
+	if im.name != EnvModuleName {
+		fullName = im.name + "." + name
+	}
+	host := &hostFunc{name: fullName, fn: fn}
+	if entry, exist := im.Exports.Entries[name]; exist {
+		im.Module.FunctionIndexSpace[entry.Index].Sig = &sig
+		im.Module.FunctionIndexSpace[entry.Index].Host = host
 		return
 	}
 
-	env.Exports.Names = append(env.Exports.Names, name)
-	env.Exports.Entries[name] = wasm.ExportEntry{
+	im.Exports.Names = append(im.Exports.Names, name)
+	im.Exports.Entries[name] = wasm.ExportEntry{
 		FieldStr: name,
 		Kind:     wasm.ExternalFunction,
-		Index:    env.importFuncCnt,
+		Index:    im.importFuncCnt,
 	}
-	env.Module.FunctionIndexSpace = append(env.Module.FunctionIndexSpace, wasm.Function{
-		Sig:  &wasm.FunctionSig{},
-		Body: &wasm.FunctionBody{Module: &env.Module},
-		Host: fn,
-		Name: name,
+	im.Module.FunctionIndexSpace = append(im.Module.FunctionIndexSpace, wasm.Function{
+		Sig:  &sig,
+		Body: &wasm.FunctionBody{Module: &im.Module},
+		Host: host,
+		Name: fullName,
 	})
-	env.importFuncCnt++
+	im.importFuncCnt++
 }
 
 // RegisterGlobal Register env global for wasm module
 func (env *EnvTable) RegisterGlobal(name string, v interface{}) {
+	env.version++
 	env.Exports.Names = append(env.Exports.Names, name)
 	env.Exports.Entries[name] = wasm.ExportEntry{
 		FieldStr: name,
@@ -163,10 +459,20 @@ func (env *EnvTable) RegisterGlobal(name string, v interface{}) {
 	env.importGlobalCnt++
 }
 
-// GetFuncByName Get env function by name
+// GetFuncByName Get env function by name, functions of import modules other
+// than "env" are named "module.name".
 func (env *EnvTable) GetFuncByName(name string) EnvFunc {
-	if entry, exist := env.Exports.Entries[name]; exist {
-		return env.Module.FunctionIndexSpace[entry.Index].Host.(EnvFunc)
+	im, field := env.importModule, name
+	if _, exist := im.Exports.Entries[name]; !exist {
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if im = env.modules[name[:i]]; im == nil {
+				return nil
+			}
+			field = name[i+1:]
+		}
+	}
+	if entry, exist := im.Exports.Entries[field]; exist {
+		return im.Module.FunctionIndexSpace[entry.Index].Host.(EnvFunc)
 	}
 	return nil
 }
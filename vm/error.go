@@ -1,11 +1,17 @@
 package vm
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-interpreter/wagon/wasm"
+)
 
 var (
 	ErrOverFrame  = errors.New("engine: recursive overflow")
 	ErrEmptyFrame = errors.New("engine: empty frame")
 	ErrInitEngine = errors.New("engine: init failed")
+	ErrReentrancy = errors.New("engine: reentrancy not allowed")
 
 	ErrMemoryGet          = errors.New("memory get* failed")
 	ErrMemorySet          = errors.New("memory set* failed")
@@ -31,15 +37,261 @@ var (
 	ErrContractAssert           = errors.New("vm: contract assert fail")
 	ErrOutOfGas                 = errors.New("vm: out of gas")
 	ErrExecutionExit            = errors.New("vm: execution exit")
+
+	ErrImportModule    = errors.New("vm: unknown import module")
+	ErrImportFunc      = errors.New("vm: unknown import")
+	ErrImportSignature = errors.New("vm: import signature mismatch")
+
+	ErrInvalidABI = errors.New("vm: invalid abi")
+	ErrABIAction  = errors.New("vm: unknown abi action")
+	ErrABIArgs    = errors.New("vm: invalid abi args")
+	ErrABIOutput  = errors.New("vm: invalid abi output")
+	ErrABIEvent   = errors.New("vm: invalid abi event")
+	ErrABIExport  = errors.New("vm: abi action not exported")
+
+	ErrLimitExceeded = errors.New("vm: limit exceeded")
+	ErrInvalidLimits = errors.New("vm: invalid limits")
+
+	ErrNonDeterministic = errors.New("vm: non-deterministic module")
+
+	// Traps of the wasm code, whether it is interpreted or native.
+	ErrTrapUnreachable       = errors.New("vm: trap: unreachable")
+	ErrTrapMemoryOutOfBounds = errors.New("vm: trap: out of bounds memory access")
+	ErrTrapDivByZero         = errors.New("vm: trap: integer divide by zero")
+	ErrTrapIndirectCallType  = errors.New("vm: trap: indirect call type mismatch")
+	ErrTrapTableOutOfBounds  = errors.New("vm: trap: undefined table element")
+	ErrTrapStackOverflow     = errors.New("vm: trap: stack overflow")
+	ErrTrapForbiddenOp       = errors.New("vm: trap: forbidden operation")
+)
+
+// Status is the numeric outcome of a call, as stored in receipts. The values
+// are persisted and must never be renumbered.
+type Status uint32
+
+const (
+	StatusOK                Status = 0
+	StatusFailed            Status = 1 // any failure not listed below
+	StatusReverted          Status = 2
+	StatusOutOfGas          Status = 3
+	StatusTrap              Status = 4 // a trap not listed below
+	StatusUnreachable       Status = 5
+	StatusMemoryOutOfBounds Status = 6
+	StatusDivByZero         Status = 7
+	StatusIndirectCallType  Status = 8
+	StatusTableOutOfBounds  Status = 9
+	StatusStackOverflow     Status = 10
+	StatusForbiddenOp       Status = 11
+)
+
+var errorStatus = map[error]Status{
+	ErrExecutionReverted:     StatusReverted,
+	ErrOutOfGas:              StatusOutOfGas,
+	ErrTrapUnreachable:       StatusUnreachable,
+	ErrTrapMemoryOutOfBounds: StatusMemoryOutOfBounds,
+	ErrTrapDivByZero:         StatusDivByZero,
+	ErrTrapIndirectCallType:  StatusIndirectCallType,
+	ErrTrapTableOutOfBounds:  StatusTableOutOfBounds,
+	ErrTrapStackOverflow:     StatusStackOverflow,
+	ErrTrapForbiddenOp:       StatusForbiddenOp,
+}
+
+var statusNames = [...]string{"ok", "failed", "reverted", "out of gas", "trap", "unreachable",
+	"memory out of bounds", "divide by zero", "indirect call type mismatch", "table out of bounds",
+	"stack overflow", "forbidden operation"}
+
+func (s Status) String() string {
+	if int(s) < len(statusNames) {
+		return statusNames[s]
+	}
+	return fmt.Sprintf("status(%d)", uint32(s))
+}
+
+// StatusOf returns the status of a call which returned err.
+func StatusOf(err error) Status {
+	if err == nil {
+		return StatusOK
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if s, ok := errorStatus[e]; ok {
+			return s
+		}
+	}
+	var e *Error
+	if errors.As(err, &e) && e.Class == ClassTrap {
+		return StatusTrap
+	}
+	return StatusFailed
+}
+
+// ImportError is returned by NewApp when an import of the contract can not be
+// resolved against the EnvTable of the engine.
+type ImportError struct {
+	Module string
+	Field  string
+	Err    error
+
+	// Want and Got are the registered and the declared signatures of the
+	// import when Err is ErrImportSignature, Got is nil if the declared one
+	// is missing.
+	Want *wasm.FunctionSig
+	Got  *wasm.FunctionSig
+}
+
+func (e *ImportError) Error() string {
+	switch {
+	case e.Field == "":
+		return fmt.Sprintf("%s: %s", e.Err, e.Module)
+	case e.Want != nil:
+		return fmt.Sprintf("%s: %s.%s declared as %v, wanted %v", e.Err, e.Module, e.Field, e.Got, e.Want)
+	}
+	return fmt.Sprintf("%s: %s.%s", e.Err, e.Module, e.Field)
+}
+
+// Unwrap returns the cause of the error, one of ErrImportModule, ErrImportFunc
+// and ErrImportSignature.
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// ABIError is returned when an ABI or a call checked against it is invalid.
+type ABIError struct {
+	Action string
+	Param  string
+	Err    error
+	Msg    string
+}
+
+func (e *ABIError) Error() string {
+	s := e.Err.Error()
+	if e.Action != "" {
+		s += ": " + e.Action
+		if e.Param != "" {
+			s += "." + e.Param
+		}
+	}
+	if e.Msg != "" {
+		s += ": " + e.Msg
+	}
+	return s
+}
+
+// Unwrap returns the cause of the error, one of ErrInvalidABI, ErrABIAction,
+// ErrABIArgs, ErrABIOutput, ErrABIEvent and ErrABIExport.
+func (e *ABIError) Unwrap() error {
+	return e.Err
+}
+
+// LimitError is returned by NewApp when a module exceeds one of the Limits
+// of the engine.
+type LimitError struct {
+	Limit string
+	Value uint64
+	Max   uint64
+	Err   error
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: %s %d, max %d", e.Err, e.Limit, e.Value, e.Max)
+}
+
+// Unwrap returns the cause of the error, ErrMaxCodeSizeExceeded for the code
+// size and ErrLimitExceeded otherwise.
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// DeterminismError is returned by CheckDeterminism with every violation of
+// the policy found in a module.
+type DeterminismError struct {
+	Violations []Violation
+}
+
+func (e *DeterminismError) Error() string {
+	s := fmt.Sprintf("%s: %d violation(s)", ErrNonDeterministic, len(e.Violations))
+	for _, v := range e.Violations {
+		s += "; " + v.String()
+	}
+	return s
+}
+
+// Unwrap returns ErrNonDeterministic.
+func (e *DeterminismError) Unwrap() error {
+	return ErrNonDeterministic
+}
+
+// ErrorClass tells which part of the vm an Error comes from.
+type ErrorClass uint8
+
+const (
+	// ClassEngine is a failure of the engine before the frame runs, e.g. a
+	// call rejected by the ABI or a too deep call.
+	ClassEngine ErrorClass = iota
+	// ClassHost is a failure of a host function.
+	ClassHost
+	// ClassTrap is a trap of the wasm code.
+	ClassTrap
+	// ClassGas is running out of gas.
+	ClassGas
+	// ClassRevert is a revert or an exit of the contract.
+	ClassRevert
 )
 
+var errorClassNames = [...]string{"engine", "host", "trap", "gas", "revert"}
+
+func (c ErrorClass) String() string {
+	if int(c) < len(errorClassNames) {
+		return errorClassNames[c]
+	}
+	return fmt.Sprintf("class(%d)", uint8(c))
+}
+
+// StackFrame is an entry of the backtrace of an Error: the contract of a
+// frame and the index of the wasm function it was running, -1 if unknown.
+type StackFrame struct {
+	App  string
+	Func int64
+}
+
+// Error is returned by Engine.Run when a frame fails. Err is the cause, one
+// of the Err* values or an error of the wagon exec package, and is matched
+// by errors.Is. The failure of a nested call keeps the Error of the callee.
 type Error struct {
-	err error
-	fn  string
-	app *APP
-	eng *Engine
+	Class ErrorClass
+	Err   error
+
+	// Address is the contract which failed and Depth its frame depth, 0 for
+	// the frame started by Engine.Run. Func is the host function which
+	// failed, if any.
+	Address string
+	Depth   int
+	Func    string
+
+	// Backtrace holds one entry per frame, innermost first. The interpreter
+	// only keeps the function a frame was running when it stopped, so the
+	// functions which called it are not known.
+	Backtrace []StackFrame
+}
+
+func (e *Error) Error() string {
+	s := fmt.Sprintf("%s: %s at depth %d", e.Err, e.Address, e.Depth)
+	if e.Func != "" {
+		s += " in " + e.Func
+	}
+	return s
+}
+
+// Unwrap returns the cause of the error.
+func (e *Error) Unwrap() error {
+	return e.Err
 }
 
-func (e Error) Error() string {
-	return e.err.Error()
+// errorClass returns the class of cause, an error raised while a frame runs.
+func errorClass(cause error) ErrorClass {
+	switch cause {
+	case ErrExecutionReverted, ErrExecutionExit:
+		return ClassRevert
+	case ErrOutOfGas:
+		return ClassGas
+	}
+	return ClassTrap
 }
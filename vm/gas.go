@@ -1054,7 +1054,9 @@ func gasJSONToString(eng *Engine, index int64, args []uint64) (uint64, []byte, e
 	return gas, data, nil
 }
 
-func gasCallContract(eng *Engine, index int64, args []uint64) (uint64, error) {
+// GasCallContract charges a contract call and the copy of its action and
+// params.
+func GasCallContract(eng *Engine, index int64, args []uint64) (uint64, error) {
 	app, _ := eng.RunningAppFrame()
 	vmem := app.VM.VMemory()
 	actionLen, err := vmem.Strlen(args[1])
@@ -1080,6 +1082,31 @@ func gasCallContract(eng *Engine, index int64, args []uint64) (uint64, error) {
 	return gas, nil
 }
 
+// GasCallContractWithValue charges a contract call plus the value transfer.
+func GasCallContractWithValue(eng *Engine, index int64, args []uint64) (uint64, error) {
+	if len(args) != 5 {
+		return 0, ErrInvalidApiArgs
+	}
+	gas, err := GasCallContract(eng, index, args[:3])
+	if err != nil {
+		return 0, err
+	}
+	gas, overflow := SafeAdd(gas, CallValueTransferGas)
+	if overflow {
+		return 0, ErrGasOverflow
+	}
+	return gas, nil
+}
+
+// GasCallContractWithGas charges a contract call, the stipend is charged by
+// the callee.
+func GasCallContractWithGas(eng *Engine, index int64, args []uint64) (uint64, error) {
+	if len(args) != 4 {
+		return 0, ErrInvalidApiArgs
+	}
+	return GasCallContract(eng, index, args[:3])
+}
+
 func gasDelegateCallContract(eng *Engine, index int64, args []uint64) (uint64, error) {
 	app, _ := eng.RunningAppFrame()
 	vmem := app.VM.VMemory()
@@ -1105,3 +1132,107 @@ func gasDelegateCallContract(eng *Engine, index int64, args []uint64) (uint64, e
 	}
 	return gas, nil
 }
+
+func gasTC2CallContract(eng *Engine, index int64, args []uint64) (uint64, error) {
+	dataLen, overflow := SafeAdd(args[2], args[4])
+	if overflow {
+		return 0, ErrGasOverflow
+	}
+	gas := GasTableEIP158.Calls + GasExtStep*2
+	wordGas, overflow := SafeMul(ToWordSize(dataLen), CopyGas)
+	if overflow {
+		return 0, ErrGasOverflow
+	}
+	if gas, overflow = SafeAdd(gas, wordGas); overflow {
+		return 0, ErrGasOverflow
+	}
+	return gas, nil
+}
+
+func gasTC2Print(dataLen uint64) (uint64, error) {
+	gas := GasQuickStep
+	wordGas, overflow := SafeMul(ToWordSize(dataLen), PrintWordGas)
+	if overflow {
+		return 0, ErrGasOverflow
+	}
+	if gas, overflow = SafeAdd(gas, wordGas); overflow {
+		return 0, ErrGasOverflow
+	}
+	return gas, nil
+}
+
+func gasTC2Hash(dataLen uint64, setGas, perWordGas uint64) (uint64, error) {
+	gas := GasExtStep + setGas
+	wordGas, overflow := SafeMul(ToWordSize(dataLen), perWordGas)
+	if overflow {
+		return 0, ErrGasOverflow
+	}
+	if gas, overflow = SafeAdd(gas, wordGas); overflow {
+		return 0, ErrGasOverflow
+	}
+	return gas, nil
+}
+
+// GasTC2Notify is the gas of tc2_notify(event, event_len, data, data_len).
+func GasTC2Notify(eng *Engine, index int64, args []uint64) (uint64, error) {
+	gas := LogTopicGas
+	wordGas, overflow := SafeMul(ToWordSize(args[1]), Sha3WordGas)
+	if overflow {
+		return 0, ErrGasOverflow
+	}
+	if gas, overflow = SafeAdd(gas, wordGas); overflow {
+		return 0, ErrGasOverflow
+	}
+	memorySizeGas, overflow := SafeMul(args[3], LogDataGas)
+	if overflow {
+		return 0, ErrGasOverflow
+	}
+	if gas, overflow = SafeAdd(gas, memorySizeGas); overflow {
+		return 0, ErrGasOverflow
+	}
+	return gas, nil
+}
+
+// GasTC2Log is the gas of tc2_log(topics, n, data, data_len).
+func GasTC2Log(eng *Engine, index int64, args []uint64) (uint64, error) {
+	topicGas, overflow := SafeMul(args[1], LogTopicGas)
+	if overflow {
+		return 0, ErrGasOverflow
+	}
+	gas, overflow := SafeAdd(GasFastStep, topicGas)
+	if overflow {
+		return 0, ErrGasOverflow
+	}
+	memorySizeGas, overflow := SafeMul(args[3], LogDataGas)
+	if overflow {
+		return 0, ErrGasOverflow
+	}
+	if gas, overflow = SafeAdd(gas, memorySizeGas); overflow {
+		return 0, ErrGasOverflow
+	}
+	return gas, nil
+}
+
+func gasSetReturnData(eng *Engine, index int64, args []uint64) (uint64, error) {
+	gas := GasQuickStep
+	wordGas, overflow := SafeMul(ToWordSize(args[1]), CopyGas)
+	if overflow {
+		return 0, ErrGasOverflow
+	}
+	if gas, overflow = SafeAdd(gas, wordGas); overflow {
+		return 0, ErrGasOverflow
+	}
+	return gas, nil
+}
+
+func gasReturnDataCopy(eng *Engine, index int64, args []uint64) (uint64, error) {
+	gas := GasFastestStep
+	wordGas, overflow := SafeMul(ToWordSize(args[2]), CopyGas)
+	if overflow {
+		return 0, ErrGasOverflow
+	}
+	if gas, overflow = SafeAdd(gas, wordGas); overflow {
+		return 0, ErrGasOverflow
+	}
+	return gas, nil
+}
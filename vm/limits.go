@@ -0,0 +1,163 @@
+package vm
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/go-interpreter/wagon/exec"
+	"github.com/go-interpreter/wagon/wasm"
+)
+
+// Limits caps the resources of the contracts run by an engine. Modules
+// exceeding a limit are rejected by NewApp, frames nested deeper than
+// FrameDepth fail with ErrOverFrame. None of the limits may be negative,
+// MemoryPages must be between 1 and 65536 and TableEntries at most
+// maxTableEntries.
+type Limits struct {
+	// MemoryPages caps the initial size of the linear memory, in pages of
+	// 64KiB, and the size grow_memory and the allocator grow it to, beyond
+	// which they fail. The allocator of the VM rejects more than 16 initial
+	// pages.
+	MemoryPages uint32
+	// FrameDepth caps the number of calling frames, see PushAppFrame.
+	FrameDepth int
+	// CodeSize caps the size of the code of a contract, in bytes.
+	CodeSize int
+	// Functions and Globals cap the number of functions and globals defined
+	// by a module, imports excluded.
+	Functions int
+	Globals   int
+	// Locals caps the number of locals of a function, parameters excluded.
+	Locals int
+	// TableEntries caps the initial and the declared maximum size of the
+	// table.
+	TableEntries uint32
+	// DataSize caps the total size of the data segments, in bytes.
+	DataSize int
+}
+
+// Largest memory, in pages, and table, in entries, a module may declare. The
+// table is bounded as in the wasm JavaScript API, the binary format bounds it
+// by its encoding only.
+const (
+	maxMemoryPages  = 65536
+	maxTableEntries = 10000000
+)
+
+// DefaultLimits are used by engines created without limits. They reject
+// no contract accepted before the limits existed: the functions, globals and
+// data of a module can not outnumber the bytes of its code, the memory is
+// bounded by memory.DefaultMaxHeapMemSize, the locals were not bounded and
+// the table is bounded by maxTableEntries only.
+var DefaultLimits = Limits{
+	MemoryPages:  16,
+	FrameDepth:   64,
+	CodeSize:     MaxCodeSize,
+	Functions:    MaxCodeSize,
+	Globals:      MaxCodeSize,
+	Locals:       math.MaxInt32,
+	TableEntries: maxTableEntries,
+	DataSize:     MaxCodeSize,
+}
+
+// check returns ErrInvalidLimits if one of the limits is negative or out of
+// the range of the wasm memory and table.
+func (l *Limits) check() error {
+	for _, n := range []int{l.FrameDepth, l.CodeSize, l.Functions, l.Globals, l.Locals, l.DataSize} {
+		if n < 0 {
+			return ErrInvalidLimits
+		}
+	}
+	if l.MemoryPages == 0 || l.MemoryPages > maxMemoryPages || l.TableEntries > maxTableEntries {
+		return ErrInvalidLimits
+	}
+	return nil
+}
+
+// capMemory bounds the memory of vm to MemoryPages.
+func (l *Limits) capMemory(vm *exec.VM) {
+	vm.VMemory().SetMaxHeapSize(int(l.MemoryPages) * wasmPageSize)
+}
+
+// key returns the limits encoded for AppCache keys.
+func (l *Limits) key() []byte {
+	values := []uint64{uint64(l.MemoryPages), uint64(l.FrameDepth), uint64(l.CodeSize), uint64(l.Functions),
+		uint64(l.Globals), uint64(l.Locals), uint64(l.TableEntries), uint64(l.DataSize)}
+	b := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint64(b[8*i:], v)
+	}
+	return b
+}
+
+// checkCode checks the size of code before it is parsed.
+func (l *Limits) checkCode(code []byte) error {
+	if len(code) > l.CodeSize {
+		return &LimitError{Limit: "code size", Value: uint64(len(code)), Max: uint64(l.CodeSize), Err: ErrMaxCodeSizeExceeded}
+	}
+	return nil
+}
+
+// checkModule checks m, a decoded module, against the limits.
+func (l *Limits) checkModule(m *wasm.Module) error {
+	// The declared maximum of the memory is not checked, the memory can
+	// not grow past MemoryPages anyway.
+	if m.Memory != nil && len(m.Memory.Entries) != 0 {
+		if initial := m.Memory.Entries[0].Limits.Initial; initial > l.MemoryPages {
+			return &LimitError{Limit: "memory pages", Value: uint64(initial), Max: uint64(l.MemoryPages), Err: ErrLimitExceeded}
+		}
+	}
+	if m.Table != nil && len(m.Table.Entries) != 0 {
+		if err := checkResizable("table entries", m.Table.Entries[0].Limits, l.TableEntries); err != nil {
+			return err
+		}
+	}
+	if m.Function != nil && len(m.Function.Types) > l.Functions {
+		return &LimitError{Limit: "functions", Value: uint64(len(m.Function.Types)), Max: uint64(l.Functions), Err: ErrLimitExceeded}
+	}
+	if m.Global != nil && len(m.Global.Globals) > l.Globals {
+		return &LimitError{Limit: "globals", Value: uint64(len(m.Global.Globals)), Max: uint64(l.Globals), Err: ErrLimitExceeded}
+	}
+	if m.Code != nil {
+		for _, body := range m.Code.Bodies {
+			var n uint64
+			for _, local := range body.Locals {
+				n += uint64(local.Count)
+			}
+			if n > uint64(l.Locals) {
+				return &LimitError{Limit: "locals", Value: n, Max: uint64(l.Locals), Err: ErrLimitExceeded}
+			}
+		}
+	}
+	if m.Data != nil {
+		var n uint64
+		for _, segment := range m.Data.Entries {
+			n += uint64(len(segment.Data))
+			// Segments past the memory are rejected, the offsets of those
+			// placed by a global are not known before the imports are
+			// resolved.
+			if off, err := m.ExecInitExpr(segment.Offset); err == nil {
+				if off, ok := off.(int32); ok {
+					end := uint64(uint32(off)) + uint64(len(segment.Data))
+					if max := uint64(l.MemoryPages) * wasmPageSize; end > max {
+						return &LimitError{Limit: "data end", Value: end, Max: max, Err: ErrLimitExceeded}
+					}
+				}
+			}
+		}
+		if n > uint64(l.DataSize) {
+			return &LimitError{Limit: "data size", Value: n, Max: uint64(l.DataSize), Err: ErrLimitExceeded}
+		}
+	}
+	return nil
+}
+
+func checkResizable(name string, limits wasm.ResizableLimits, max uint32) error {
+	if limits.Initial > max {
+		return &LimitError{Limit: name, Value: uint64(limits.Initial), Max: uint64(max), Err: ErrLimitExceeded}
+	}
+	if limits.Flags&0x1 != 0 && limits.Maximum > max {
+		return &LimitError{Limit: name, Value: uint64(limits.Maximum), Max: uint64(max), Err: ErrLimitExceeded}
+	}
+	return nil
+}
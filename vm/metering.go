@@ -0,0 +1,285 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/go-interpreter/wagon/wasm"
+	"github.com/go-interpreter/wagon/wasm/leb128"
+	ops "github.com/go-interpreter/wagon/wasm/operators"
+)
+
+// GasFuncName is the function, imported from the "env" module, through which
+// instrumented contracts are charged for their instructions.
+//
+// void gas(int64_t cost)
+const GasFuncName = "gas"
+
+// GasSchedule is the cost of the wasm operators charged to the contracts
+// rewritten by Instrument.
+type GasSchedule struct {
+	// Ops holds the cost of each operator, by opcode. The cost of call does
+	// not include the gas of the host function called, which is charged when
+	// it runs.
+	Ops [256]uint64
+	// MemoryPage is the cost of each page grow_memory is asked for, charged
+	// right before it runs. It must be less than 2^32 for the cost of any
+	// number of pages to fit in 64 bits.
+	MemoryPage uint64
+}
+
+// DefaultGasSchedule charges the operators what the interpreter charges for
+// them in contracts which are not instrumented, and MemPageGas per page asked
+// for by grow_memory, which the interpreter charges as a constant. The
+// interpreter also charges the code its compiler adds: the stack adjustments
+// of branches and the nop run when a function returns by reaching its end.
+var DefaultGasSchedule = defaultGasSchedule()
+
+func defaultGasSchedule() GasSchedule {
+	var s GasSchedule
+	for op := range s.Ops {
+		if _, err := ops.New(byte(op)); err == nil {
+			s.Ops[op] = GasFastestStep
+		}
+	}
+	for _, op := range []byte{ops.Block, ops.Loop, ops.End, ops.Return, ops.Call} {
+		s.Ops[op] = 0
+	}
+	for _, op := range []byte{ops.If, ops.Else, ops.Br, ops.BrIf, ops.BrTable, ops.I32Clz, ops.I32Ctz, ops.I32Popcnt} {
+		s.Ops[op] = GasQuickStep
+	}
+	s.MemoryPage = MemPageGas
+	return s
+}
+
+// key returns the schedule encoded for AppCache keys.
+func (s *GasSchedule) key() []byte {
+	b := make([]byte, 8*len(s.Ops)+8)
+	for i, cost := range s.Ops {
+		binary.BigEndian.PutUint64(b[8*i:], cost)
+	}
+	binary.BigEndian.PutUint64(b[8*len(s.Ops):], s.MemoryPage)
+	return b
+}
+
+// Instrument returns code, a wasm module, rewritten to be charged for its
+// instructions according to schedule: each basic block starts by calling the
+// GasFuncName function with the cost of its operators, and grow_memory is
+// preceded by a call charging the pages it is asked for, kept meanwhile in an
+// i32 local added to the function. The gas function is imported if code does
+// not import it yet, shifting the indices of the functions of code by one;
+// the name section, which only holds debug information, is then dropped
+// rather than renumbered.
+func Instrument(code []byte, schedule *GasSchedule) ([]byte, error) {
+	m, err := wasm.DecodeModule(bytes.NewReader(code))
+	if err != nil {
+		return nil, err
+	}
+	gasFunc, shift := importGasFunc(m)
+	if shift {
+		dropNames(m)
+	}
+	if m.Code != nil {
+		for i := range m.Code.Bodies {
+			body := &m.Code.Bodies[i]
+			scratch, err := localCount(m, i)
+			if err != nil {
+				return nil, err
+			}
+			var grows bool
+			if body.Code, grows, err = meterCode(body.Code, schedule, gasFunc, shift, scratch); err != nil {
+				return nil, err
+			}
+			if grows {
+				body.Locals = append(body.Locals, wasm.LocalEntry{Count: 1, Type: wasm.ValueTypeI32})
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := wasm.EncodeModule(buf, m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// importGasFunc returns the index of the gas function imported by m, and
+// whether the import was added. An added import takes the index of the first
+// function of m, the indices of the exports, the elements and the start
+// function are shifted accordingly, those of the calls by meterCode.
+func importGasFunc(m *wasm.Module) (uint32, bool) {
+	sig := wasm.FunctionSig{Form: wasm.TypeFunc, ParamTypes: []wasm.ValueType{wasm.ValueTypeI64}}
+	var index uint32
+	if m.Import != nil {
+		for _, entry := range m.Import.Entries {
+			fi, ok := entry.Type.(wasm.FuncImport)
+			if !ok {
+				continue
+			}
+			if entry.ModuleName == EnvModuleName && entry.FieldName == GasFuncName &&
+				int(fi.Type) < len(m.Types.Entries) && sameSig(&sig, &m.Types.Entries[fi.Type]) {
+				return index, false
+			}
+			index++
+		}
+	}
+
+	if m.Types == nil {
+		m.Types = &wasm.SectionTypes{}
+		addSection(m, m.Types)
+	}
+	typ := len(m.Types.Entries)
+	for i := range m.Types.Entries {
+		if sameSig(&sig, &m.Types.Entries[i]) {
+			typ = i
+			break
+		}
+	}
+	if typ == len(m.Types.Entries) {
+		m.Types.Entries = append(m.Types.Entries, sig)
+	}
+	if m.Import == nil {
+		m.Import = &wasm.SectionImports{}
+		addSection(m, m.Import)
+	}
+	m.Import.Entries = append(m.Import.Entries, wasm.ImportEntry{
+		ModuleName: EnvModuleName,
+		FieldName:  GasFuncName,
+		Type:       wasm.FuncImport{Type: uint32(typ)},
+	})
+
+	if m.Export != nil {
+		for name, entry := range m.Export.Entries {
+			if entry.Kind == wasm.ExternalFunction && entry.Index >= index {
+				entry.Index++
+				m.Export.Entries[name] = entry
+			}
+		}
+	}
+	if m.Elements != nil {
+		for _, segment := range m.Elements.Entries {
+			for i, elem := range segment.Elems {
+				if elem >= index {
+					segment.Elems[i]++
+				}
+			}
+		}
+	}
+	if m.Start != nil && m.Start.Index >= index {
+		m.Start.Index++
+	}
+	return index, true
+}
+
+// dropNames removes the name section of m.
+func dropNames(m *wasm.Module) {
+	sections := m.Sections[:0]
+	for _, s := range m.Sections {
+		if c, ok := s.(*wasm.SectionCustom); !ok || c.Name != wasm.CustomSectionName {
+			sections = append(sections, s)
+		}
+	}
+	m.Sections = sections
+	customs := m.Customs[:0]
+	for _, c := range m.Customs {
+		if c.Name != wasm.CustomSectionName {
+			customs = append(customs, c)
+		}
+	}
+	m.Customs = customs
+}
+
+// localCount returns the number of locals, parameters included, of the i-th
+// function defined by m.
+func localCount(m *wasm.Module, i int) (uint32, error) {
+	if m.Function == nil || i >= len(m.Function.Types) || m.Types == nil ||
+		int(m.Function.Types[i]) >= len(m.Types.Entries) {
+		return 0, fmt.Errorf("no signature for function body %d", i)
+	}
+	n := uint32(len(m.Types.Entries[m.Function.Types[i]].ParamTypes))
+	for _, entry := range m.Code.Bodies[i].Locals {
+		n += entry.Count
+	}
+	return n, nil
+}
+
+// addSection adds s to the sections of m, which are encoded in order.
+func addSection(m *wasm.Module, s wasm.Section) {
+	i := 0
+	for ; i < len(m.Sections); i++ {
+		id := m.Sections[i].SectionID()
+		if id != wasm.SectionIDCustom && id > s.SectionID() {
+			break
+		}
+	}
+	m.Sections = append(m.Sections, nil)
+	copy(m.Sections[i+1:], m.Sections[i:])
+	m.Sections[i] = s
+}
+
+// meterCode returns code, the body of a function, with a call to the gas
+// function at gasFunc at the start of each basic block, charging the cost of
+// its operators. A block ends after an operator which branches or is branched
+// to, the code after an unconditional branch is charged only if it is reached.
+// If shift is set, the calls to the functions from gasFunc on are shifted by
+// one. Unless schedule.MemoryPage is 0, each grow_memory is preceded by a call
+// to the gas function with the cost of the pages it is asked for, which are
+// kept in the local at scratch; the returned bool tells if there was any.
+func meterCode(code []byte, schedule *GasSchedule, gasFunc uint32, shift bool, scratch uint32) ([]byte, bool, error) {
+	out := make([]byte, 0, len(code)+len(code)/4)
+	var block []byte
+	var cost uint64
+	flush := func() {
+		if cost != 0 {
+			out = append(out, ops.I64Const)
+			out = leb128.AppendSleb128(out, int64(cost))
+			out = append(out, ops.Call)
+			out = leb128.AppendUleb128(out, uint64(gasFunc))
+		}
+		out = append(out, block...)
+		block, cost = block[:0], 0
+	}
+
+	var grows bool
+	r := bytes.NewReader(code)
+	for r.Len() > 0 {
+		start := len(code) - r.Len()
+		op, _ := r.ReadByte()
+		if _, err := ops.New(op); err != nil {
+			return nil, false, err
+		}
+		if op == ops.GrowMemory && schedule.MemoryPage != 0 {
+			// tee_local scratch; i64.extend_u/i32; i64.const MemoryPage;
+			// i64.mul; call gasFunc; get_local scratch
+			block = leb128.AppendUleb128(append(block, ops.TeeLocal), uint64(scratch))
+			block = leb128.AppendSleb128(append(block, ops.I64ExtendUI32, ops.I64Const), int64(schedule.MemoryPage))
+			block = leb128.AppendUleb128(append(block, ops.I64Mul, ops.Call), uint64(gasFunc))
+			block = leb128.AppendUleb128(append(block, ops.GetLocal), uint64(scratch))
+			grows = true
+		}
+		if op == ops.Call && shift {
+			index, err := leb128.ReadVarUint32(r)
+			if err != nil {
+				return nil, false, err
+			}
+			if index >= gasFunc {
+				index++
+			}
+			block = leb128.AppendUleb128(append(block, op), uint64(index))
+		} else {
+			if err := skipImmediates(r, op); err != nil {
+				return nil, false, err
+			}
+			block = append(block, code[start:len(code)-r.Len()]...)
+		}
+		cost += schedule.Ops[op]
+
+		switch op {
+		case ops.Loop, ops.If, ops.Else, ops.End, ops.Br, ops.BrIf, ops.BrTable, ops.Return, ops.Unreachable:
+			flush()
+		}
+	}
+	flush()
+	return out, grows, nil
+}
@@ -0,0 +1,172 @@
+package vm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/go-interpreter/wagon/wasm"
+	ops "github.com/go-interpreter/wagon/wasm/operators"
+	"github.com/xunleichain/tc-wasm/mock/wasmtest"
+)
+
+func TestMeterCode(t *testing.T) {
+	var free GasSchedule
+	calls := []byte{ops.Call, 0, ops.Call, 1, ops.Call, 0x7f, ops.End}
+	charged := free
+	charged.Ops[ops.Call] = 1
+	charged.Ops[ops.End] = 2
+	pages := free
+	pages.MemoryPage = 1000
+
+	tests := []struct {
+		code     []byte
+		schedule *GasSchedule
+		gasFunc  uint32
+		shift    bool
+		want     []byte
+		grows    bool
+	}{
+		// the calls from gasFunc on are shifted, 127 takes a second byte
+		{calls, &free, 1, true, []byte{ops.Call, 0, ops.Call, 2, ops.Call, 0x80, 0x01, ops.End}, false},
+		{calls, &free, 0, true, []byte{ops.Call, 1, ops.Call, 2, ops.Call, 0x80, 0x01, ops.End}, false},
+		{calls, &free, 1, false, calls, false},
+		// the block is charged before its first operator, the shifted call
+		// to the gas function itself is not
+		{calls, &charged, 1, true, []byte{ops.I64Const, 5, ops.Call, 1, ops.Call, 0, ops.Call, 2, ops.Call, 0x80, 0x01, ops.End}, false},
+		// the code after br is a block of its own
+		{[]byte{ops.Call, 0, ops.Br, 0, ops.Call, 0, ops.End}, &charged, 1, false,
+			[]byte{ops.I64Const, 1, ops.Call, 1, ops.Call, 0, ops.Br, 0, ops.I64Const, 3, ops.Call, 1, ops.Call, 0, ops.End}, false},
+		// br_table and its targets are copied as they are
+		{[]byte{ops.BrTable, 2, 0, 1, 0, ops.End}, &free, 0, true, []byte{ops.BrTable, 2, 0, 1, 0, ops.End}, false},
+		// grow_memory is charged for its pages, kept in the local at 3
+		{[]byte{ops.I32Const, 1, ops.GrowMemory, 0, ops.End}, &pages, 1, false,
+			[]byte{ops.I32Const, 1, ops.TeeLocal, 3, ops.I64ExtendUI32, ops.I64Const, 0xe8, 0x07, ops.I64Mul, ops.Call, 1, ops.GetLocal, 3,
+				ops.GrowMemory, 0, ops.End}, true},
+		{[]byte{ops.I32Const, 1, ops.GrowMemory, 0, ops.End}, &free, 1, false, []byte{ops.I32Const, 1, ops.GrowMemory, 0, ops.End}, false},
+	}
+	for i, tt := range tests {
+		got, grows, err := meterCode(tt.code, tt.schedule, tt.gasFunc, tt.shift, 3)
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Fatalf("case %d: wanted(%x), got(%x)", i, tt.want, got)
+		}
+		if grows != tt.grows {
+			t.Fatalf("case %d: grows: wanted(%v), got(%v)", i, tt.grows, grows)
+		}
+	}
+
+	if _, _, err := meterCode([]byte{ops.Call}, &free, 0, true, 0); err == nil {
+		t.Fatalf("truncated call accepted")
+	}
+}
+
+func TestImportGasFunc(t *testing.T) {
+	gasSig := wasm.FunctionSig{Form: wasm.TypeFunc, ParamTypes: []wasm.ValueType{wasm.ValueTypeI64}}
+	otherSig := wasm.FunctionSig{Form: wasm.TypeFunc, ParamTypes: []wasm.ValueType{wasm.ValueTypeI32}}
+	module := func(imports ...wasm.ImportEntry) *wasm.Module {
+		m := &wasm.Module{
+			Types: &wasm.SectionTypes{Entries: []wasm.FunctionSig{otherSig, gasSig}},
+			Export: &wasm.SectionExports{Entries: map[string]wasm.ExportEntry{
+				"f0":     {FieldStr: "f0", Kind: wasm.ExternalFunction, Index: 0},
+				"f1":     {FieldStr: "f1", Kind: wasm.ExternalFunction, Index: 1},
+				"memory": {FieldStr: "memory", Kind: wasm.ExternalMemory, Index: 0},
+			}},
+			Elements: &wasm.SectionElements{Entries: []wasm.ElementSegment{{Elems: []uint32{0, 1, 1}}}},
+			Start:    &wasm.SectionStartFunction{Index: 1},
+		}
+		if len(imports) != 0 {
+			m.Import = &wasm.SectionImports{Entries: imports}
+		}
+		return m
+	}
+	other := wasm.ImportEntry{ModuleName: EnvModuleName, FieldName: "other", Type: wasm.FuncImport{Type: 0}}
+	gas := wasm.ImportEntry{ModuleName: EnvModuleName, FieldName: GasFuncName, Type: wasm.FuncImport{Type: 1}}
+	badGas := wasm.ImportEntry{ModuleName: EnvModuleName, FieldName: GasFuncName, Type: wasm.FuncImport{Type: 0}}
+	memory := wasm.ImportEntry{ModuleName: EnvModuleName, FieldName: "memory", Type: wasm.MemoryImport{}}
+
+	tests := []struct {
+		m      *wasm.Module
+		index  uint32
+		added  bool
+		f0, f1 uint32
+		elems  []uint32
+		start  uint32
+	}{
+		// the gas function takes index 0, every function is shifted
+		{module(), 0, true, 1, 2, []uint32{1, 2, 2}, 2},
+		// the imported function keeps its index, those after it are shifted
+		{module(other), 1, true, 0, 2, []uint32{0, 2, 2}, 2},
+		// imports which are not functions take no function index
+		{module(memory, other), 1, true, 0, 2, []uint32{0, 2, 2}, 2},
+		// the gas function imported already is used as it is
+		{module(other, gas), 1, false, 0, 1, []uint32{0, 1, 1}, 1},
+		// but not with another signature
+		{module(badGas), 1, true, 0, 2, []uint32{0, 2, 2}, 2},
+	}
+	for i, tt := range tests {
+		index, added := importGasFunc(tt.m)
+		if index != tt.index || added != tt.added {
+			t.Fatalf("case %d: wanted(%d, %v), got(%d, %v)", i, tt.index, tt.added, index, added)
+		}
+		exports := tt.m.Export.Entries
+		if exports["f0"].Index != tt.f0 || exports["f1"].Index != tt.f1 {
+			t.Fatalf("case %d: exports: wanted(%d, %d), got(%d, %d)", i, tt.f0, tt.f1, exports["f0"].Index, exports["f1"].Index)
+		}
+		if exports["memory"].Index != 0 {
+			t.Fatalf("case %d: memory export shifted to %d", i, exports["memory"].Index)
+		}
+		if elems := tt.m.Elements.Entries[0].Elems; !reflect.DeepEqual(elems, tt.elems) {
+			t.Fatalf("case %d: elements: wanted(%v), got(%v)", i, tt.elems, elems)
+		}
+		if tt.m.Start.Index != tt.start {
+			t.Fatalf("case %d: start: wanted(%d), got(%d)", i, tt.start, tt.m.Start.Index)
+		}
+		if added {
+			imports := tt.m.Import.Entries
+			last := imports[len(imports)-1]
+			if last.ModuleName != EnvModuleName || last.FieldName != GasFuncName || last.Type.(wasm.FuncImport).Type != 1 {
+				t.Fatalf("case %d: import: got(%+v)", i, last)
+			}
+		}
+	}
+}
+
+func TestInstrumentNames(t *testing.T) {
+	i64 := wasmtest.I64
+	// a function names subsection naming function 0 "f"
+	names := wasmtest.Custom{Name: wasm.CustomSectionName, Payload: []byte{1, 4, 1, 0, 1, 'f'}}
+	module := func(imports ...wasmtest.Import) []byte {
+		m := wasmtest.Module{
+			Types:   []wasmtest.Type{{}, {Params: []byte{i64}}},
+			Imports: imports,
+			Funcs:   []wasmtest.Func{{}},
+			Customs: []wasmtest.Custom{names},
+		}
+		return m.Bytes()
+	}
+
+	tests := []struct {
+		code  []byte
+		named bool
+	}{
+		// the added gas function would shift the named function
+		{module(), false},
+		{module(wasmtest.Import{Module: EnvModuleName, Field: GasFuncName, Type: 1}), true},
+	}
+	for i, tt := range tests {
+		code, err := Instrument(tt.code, &DefaultGasSchedule)
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		m, err := wasm.DecodeModule(bytes.NewReader(code))
+		if err != nil {
+			t.Fatalf("case %d: decode: %v", i, err)
+		}
+		if named := m.Custom(wasm.CustomSectionName) != nil; named != tt.named {
+			t.Fatalf("case %d: name section: wanted(%v), got(%v)", i, tt.named, named)
+		}
+	}
+}
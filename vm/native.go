@@ -15,6 +15,10 @@ typedef struct {
 	uint64_t gas_used;
 	int32_t pages;
 	uint8_t *mem;
+	// index of the function running
+	uint32_t findex;
+	// number of nested calls of the function running
+	uint32_t depth;
 
 	// internal temp member
 	void *_ff;
@@ -63,6 +67,8 @@ static uint32_t call_main(void *__ptrs) {
 	vm.gas_used = data[1];
 	vm.pages = (int32_t)(data[2]);
 	vm.mem = (uint8_t *)(mem);
+	vm.findex = 0;
+	vm.depth = 0;
 
 	uint32_t action = (uint32_t)(data[3]);
 	uint32_t args = (uint32_t)(data[4]);
@@ -79,6 +85,51 @@ static uint32_t call_main(void *__ptrs) {
 	return ret;
 }
 
+typedef uint64_t (*tc_call_t)(vm_t*, uint32_t, uint64_t*);
+
+static inline tc_call_t get_call_func(void *dl) {
+	return (uint64_t (*)(vm_t*, uint32_t, uint64_t*))dlsym(dl, "thunderchain_call");
+}
+
+static inline int32_t has_call_func(void *dl) {
+	tc_call_t _call = get_call_func(dl);
+	return _call ? 1 : 0;
+}
+
+static uint64_t call_export(void *__ptrs) {
+	void *_ptrs[7];
+	memcpy(&_ptrs[0], __ptrs, 7 * sizeof(void *));
+
+	void *dl = _ptrs[0];
+	void *ctx = _ptrs[1];
+	uint64_t *data = (uint64_t *)(_ptrs[2]);
+	void *mem = _ptrs[3];
+	uint64_t *gas_used = (uint64_t *)(_ptrs[4]);
+	uint64_t *gas = (uint64_t *)(_ptrs[5]);
+	uint64_t *args = (uint64_t *)(_ptrs[6]);
+
+	vm_t vm;
+	vm.ctx = ctx;
+	vm.gas = data[0];
+	vm.gas_used = data[1];
+	vm.pages = (int32_t)(data[2]);
+	vm.mem = (uint8_t *)(mem);
+	vm.findex = 0;
+	vm.depth = 0;
+
+	uint32_t index = (uint32_t)(data[3]);
+
+	tc_call_t _call = get_call_func(dl);
+	if (_call == NULL) {
+		return 0;
+	}
+
+	uint64_t ret = _call(&vm, index, args);
+
+	get_gas(&vm, gas_used, gas);
+	return ret;
+}
+
 */
 import "C"
 import (
@@ -103,6 +154,10 @@ type Native struct {
 	dl     *dynamicLib
 	t      time.Time
 	ret    uint64
+
+	// fn is the index of the function running when the native code last
+	// called back into Go, -1 before.
+	fn int64
 }
 
 // NewNative --
@@ -119,6 +174,7 @@ func NewNative(app *APP, file string) (*Native, error) {
 		app:    app,
 		logger: app.logger,
 		t:      time.Now(),
+		fn:     -1,
 	}
 
 	if ret := C.has_main_func(handle); ret < 0 {
@@ -130,6 +186,35 @@ func NewNative(app *APP, file string) (*Native, error) {
 	return native, nil
 }
 
+// CompileNative generates the C code of app and compiles it into dir right
+// away, bypassing the AotService. It is meant for tools and tests that need
+// the native code of a contract, the caller releases it with Close.
+func CompileNative(app *APP, dir string) (*Native, error) {
+	ctx := exec.NewCGenContext(app.VM, false)
+	ctx.DisableGas(app.metered)
+	code, err := ctx.Generate()
+	if err != nil {
+		return nil, fmt.Errorf("generate C code fail: %s", err)
+	}
+	file, err := ctx.Compile(code, dir, app.String())
+	if err != nil {
+		return nil, fmt.Errorf("compile C code fail: %s", err)
+	}
+	return NewNative(app, file)
+}
+
+// SetNative makes app run the given native code, or interpreted if native
+// is nil.
+func (app *APP) SetNative(native *Native) {
+	app.native.close()
+	app.native = native.clone(app)
+}
+
+// Close releases the native code.
+func (native *Native) Close() {
+	native.close()
+}
+
 func (native *Native) close() {
 	if native != nil {
 		native.dl.free()
@@ -162,6 +247,7 @@ func (native *Native) clone(app *APP) *Native {
 		logger: app.logger,
 		dl:     dl,
 		t:      t,
+		fn:     -1,
 	}
 }
 
@@ -192,28 +278,68 @@ func (native *Native) RunCMain(action, args string) (ret uint64, err error) {
 	ptrs[4] = uintptr(unsafe.Pointer(&gasUsed))
 	ptrs[5] = uintptr(unsafe.Pointer(&gas))
 
-	defer func() {
-		if r := recover(); r != nil {
-			eng.logger.Debug("[Native] RunCMain recover", "frame_index", eng.FrameIndex, "running_app", eng.runningFrame.String(), "err", err, "bt", string(debug.Stack()))
-			switch e := r.(type) {
-			case error:
-				err = e
-				if err == ErrExecutionExit {
-					ret = native.ret
-					err = nil
-				}
-			default:
-				err = fmt.Errorf("exec: %v", e)
-			}
-		}
-	}()
-
+	defer native.recover("RunCMain", &ret, &err)
 	iret := C.call_main(unsafe.Pointer(&ptrs[0]))
 	native.updateGas(gas, gasUsed)
 	native.app.logger.Debug("[Native] RunCMain done", "app", native.name(), "ret", iret, "gas", gas, "gas_used", gasUsed)
 	return uint64(iret), nil
 }
 
+// HasExport reports whether the native code dispatches the exported
+// functions, which the code compiled by older versions does not.
+func (native *Native) HasExport() bool {
+	return C.has_call_func(native.dl.so) == 1
+}
+
+// RunExport calls the exported function at fnIndex with args, the bits of
+// its arguments, and returns the bits of its result.
+func (native *Native) RunExport(fnIndex int64, args ...uint64) (ret uint64, err error) {
+	eng := native.engine()
+	mem := native.memory()
+
+	var gas uint64
+	var gasUsed uint64
+	pages := uint64(mem.HeapSize() / wasmPageSize)
+	data := []uint64{eng.gas, eng.gasUsed, pages, uint64(fnIndex)}
+	argv := make([]uint64, len(args)+1)
+	copy(argv, args)
+
+	ptrs := make([]uintptr, 7)
+	ptrs[0] = uintptr(native.dl.so)
+	ptrs[1] = uintptr(unsafe.Pointer(native))
+	ptrs[2] = uintptr(unsafe.Pointer(&data[0]))
+	ptrs[3] = uintptr(unsafe.Pointer(&mem.Memory[0]))
+	ptrs[4] = uintptr(unsafe.Pointer(&gasUsed))
+	ptrs[5] = uintptr(unsafe.Pointer(&gas))
+	ptrs[6] = uintptr(unsafe.Pointer(&argv[0]))
+
+	defer native.recover("RunExport", &ret, &err)
+
+	iret := C.call_export(unsafe.Pointer(&ptrs[0]))
+	native.updateGas(gas, gasUsed)
+	native.app.logger.Debug("[Native] RunExport done", "app", native.name(), "fn_index", fnIndex, "ret", iret, "gas", gas, "gas_used", gasUsed)
+	return uint64(iret), nil
+}
+
+// recover turns the panic of a run, if any, into its error, TC_Exit into
+// its status.
+func (native *Native) recover(name string, ret *uint64, err *error) {
+	if r := recover(); r != nil {
+		eng := native.engine()
+		eng.logger.Debug("[Native] "+name+" recover", "frame_index", eng.FrameIndex, "running_app", eng.runningFrame.String(), "err", r, "bt", string(debug.Stack()))
+		switch e := r.(type) {
+		case error:
+			*err = e
+			if e == ErrExecutionExit {
+				*ret = native.ret
+				*err = nil
+			}
+		default:
+			*err = fmt.Errorf("exec: %v", e)
+		}
+	}
+}
+
 // Printf --
 func (native *Native) Printf(f string, args ...interface{}) {
 	native.logger.Debug(fmt.Sprintf(f, args...))
@@ -233,7 +359,7 @@ func (native *Native) memory() *memory.MemManager {
 }
 
 func (native *Native) envTable() *EnvTable {
-	return native.engine().Env
+	return native.engine().importTable()
 }
 
 func (native *Native) getFuncByName(name string) EnvFunc {
@@ -273,17 +399,24 @@ func GoPanic(cvm *C.vm_t, cmsg *C.char) {
 	msg := C.GoString(cmsg)
 
 	native.updateGas(uint64(cvm.gas), uint64(cvm.gas_used))
+	native.fn = int64(cvm.findex)
 	native.Printf("[GoPanic] app:%s, msg:%s", native.name(), msg)
 
 	switch msg {
 	case "Abort":
 		panic(ErrContractAbort)
 	case "OutOfGas":
-		panic("[vm] execCode: OutOfGas") // panic(ErrOutOfGas)
+		panic(ErrOutOfGas)
 	case "Unreachable":
-		panic(exec.ErrUnreachable)
+		panic(ErrTrapUnreachable)
 	case "ElemIndexOverflow":
-		panic(exec.ErrUndefinedElementIndex)
+		panic(ErrTrapTableOutOfBounds)
+	case "SignatureMismatch":
+		panic(ErrTrapIndirectCallType)
+	case "DivZero":
+		panic(ErrTrapDivByZero)
+	case "CallStackExhausted":
+		panic(ErrTrapStackOverflow)
 	default:
 		panic(msg)
 	}
@@ -291,13 +424,19 @@ func GoPanic(cvm *C.vm_t, cmsg *C.char) {
 
 // GoRevert --
 //export GoRevert
-func GoRevert(cvm *C.vm_t, cmsg *C.char) {
+func GoRevert(cvm *C.vm_t, creason *C.char, n C.int32_t) {
 	native := (*Native)(cvm.ctx)
-	msg := C.GoString(cmsg)
+
+	// The reason is the message of the WithMsg variants, nil for the others.
+	var reason []byte
+	if creason != nil {
+		reason = C.GoBytes(unsafe.Pointer(creason), C.int(n))
+	}
 
 	native.updateGas(uint64(cvm.gas), uint64(cvm.gas_used))
-	native.Printf("[GoRevert] app:%s, msg:%s", native.name(), msg)
-	panic(ErrExecutionReverted)
+	native.fn = int64(cvm.findex)
+	native.Printf("[GoRevert] app:%s, reason:%s", native.name(), reason)
+	panic(native.engine().revert(reason))
 }
 
 // GoExit --
@@ -307,24 +446,28 @@ func GoExit(cvm *C.vm_t, cstatus C.int32_t) {
 	status := int32(cstatus)
 
 	native.updateGas(uint64(cvm.gas), uint64(cvm.gas_used))
+	native.fn = int64(cvm.findex)
 	native.Printf("[GoExit] app:%s, status:%d", native.name(), status)
 	native.ret = uint64(status)
 	panic(ErrExecutionExit)
 }
 
-// GoGrowMemory --
+// GoGrowMemory grows the memory to pages and returns the previous number of
+// pages, -1 if the memory can not grow.
 //export GoGrowMemory
-func GoGrowMemory(cvm *C.vm_t, pages C.int32_t) {
+func GoGrowMemory(cvm *C.vm_t, pages C.int32_t) C.int32_t {
 	native := (*Native)(cvm.ctx)
 	mem := native.memory()
 
+	prev := cvm.pages
 	if err := mem.GrowMem(int(pages) * wasmPageSize); err != nil {
-		native.updateGas(uint64(cvm.gas), uint64(cvm.gas_used))
 		native.Printf("[GoGrowMem] fail: app:%s, pages:%d, err:%s", native.name(), pages, err)
-		panic(err)
+		return -1
 	}
 	C.update_mem(cvm, C.int32_t(pages), unsafe.Pointer(&mem.Memory[0]))
+	native.engine().traceMemory()
 	native.Printf("[GoGrowMemory] ok: app:%s, pages:%d", native.name(), int(pages))
+	return prev
 }
 
 // GoFunc --
@@ -341,12 +484,14 @@ func GoFunc(cvm *C.vm_t, cname *C.char, cArgn C.int32_t, cArgs *C.uint64_t) uint
 	name := C.GoString(cname)
 
 	native.updateGas(uint64(cvm.gas), uint64(cvm.gas_used))
+	native.fn = int64(cvm.findex)
 	envFunc := native.getFuncByName(name)
 	if envFunc == nil {
 		native.Printf("[GoFunc] Not Exist: app:%s, name:%s", native.name(), name)
 		panic(fmt.Sprintf("[GoFunc] Not Exist: app:%s, name:%s", native.name(), name))
 	}
 
+	// envFunc reports the call to the tracer of eng, see hostFunc.
 	preFee := eng.GetFee()
 	cost, err := envFunc.Gas(index, eng, args)
 	if err != nil {
@@ -361,7 +506,7 @@ func GoFunc(cvm *C.vm_t, cname *C.char, cArgn C.int32_t, cArgs *C.uint64_t) uint
 		currentFee := eng.GetFee() - preFee
 		realCost := cost - currentFee
 		eng.CalFee(realCost, currentFee)
-		panic("[vm] execCode: OutOfGas")
+		panic(ErrOutOfGas)
 	}
 
 	ret, err := envFunc.Call(index, eng, args)
@@ -100,6 +100,7 @@ const (
 
 	PrintWordGas uint64 = 1
 	MemWordGas   uint64 = 1
+	MemPageGas   uint64 = 1000
 	IssueGas     uint64 = 4000
 	HashSetGas   uint64 = 96
 	AddrSetGas   uint64 = 60
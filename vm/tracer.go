@@ -0,0 +1,126 @@
+package vm
+
+import (
+	"github.com/xunleichain/tc-wasm/mock/types"
+)
+
+// Tracer collects a structured execution trace from the Engine. Depth is 0
+// for the frame started by Engine.Run and grows by one for each nested call.
+// Hooks are invoked synchronously, both when contracts are interpreted and
+// when they run as native code.
+type Tracer interface {
+	// CaptureEnter is called when a frame starts running action of app.
+	CaptureEnter(depth int, from types.Address, app string, action, args string, gas uint64)
+	// CaptureExit is called when a frame returns. output holds the string
+	// ret points to, if any.
+	CaptureExit(depth int, ret uint64, output []byte, gasUsed uint64, err error)
+	// CaptureHostCall is called after each host function call with the gas
+	// it was charged.
+	CaptureHostCall(depth int, name string, args []uint64, ret uint64, gas uint64, err error)
+	// CaptureMemoryGrow is called when the memory of a frame grows.
+	CaptureMemoryGrow(depth int, oldSize, newSize int)
+	// CaptureFault is called when a frame fails, before CaptureExit.
+	CaptureFault(depth int, err error)
+}
+
+// SetTracer sets the tracer of the engine, nil disables tracing.
+func (eng *Engine) SetTracer(tracer Tracer) {
+	eng.tracer = tracer
+}
+
+// Tracer returns the tracer of the engine.
+func (eng *Engine) Tracer() Tracer {
+	return eng.tracer
+}
+
+func (eng *Engine) traceDepth() int {
+	return eng.FrameIndex + 1
+}
+
+func (eng *Engine) traceEnter(app *APP, action, args string) {
+	depth := eng.traceDepth()
+	if len(eng.traceMem) > depth {
+		eng.traceMem = eng.traceMem[:depth]
+	}
+	eng.traceMem = append(eng.traceMem, len(app.VM.VMemory().Memory))
+	eng.tracer.CaptureEnter(depth, eng.Contract.CallerAddress, app.Name, action, args, eng.gas)
+}
+
+func (eng *Engine) traceExit(app *APP, ret, gasUsed uint64, err error) {
+	depth := eng.traceDepth()
+	eng.traceMemory()
+
+	var output []byte
+	switch {
+	case err != nil:
+	case eng.returnData != nil:
+		output = eng.returnData
+	case ret != 0:
+		output, _ = app.VM.VMemory().GetString(ret)
+	}
+	if err != nil {
+		eng.tracer.CaptureFault(depth, err)
+	}
+	eng.tracer.CaptureExit(depth, ret, output, gasUsed, err)
+	if len(eng.traceMem) > depth {
+		eng.traceMem = eng.traceMem[:depth]
+	}
+}
+
+// traceMemory reports the growth of the running frame's memory since it was
+// last seen. The grow_memory instruction is not visible to the interpreter
+// hooks, so its effect shows up at the next host call or frame exit.
+func (eng *Engine) traceMemory() {
+	if eng.tracer == nil || eng.runningFrame == nil {
+		return
+	}
+	depth := eng.traceDepth()
+	if depth >= len(eng.traceMem) {
+		return
+	}
+	size := len(eng.runningFrame.VM.VMemory().Memory)
+	if old := eng.traceMem[depth]; size > old {
+		eng.tracer.CaptureMemoryGrow(depth, old, size)
+	}
+	eng.traceMem[depth] = size
+}
+
+// hostFunc wraps every registered EnvFunc to report host calls to the tracer
+// of the engine, whether they come from the interpreter or from GoFunc, and to
+// return their failures as an Error naming them.
+type hostFunc struct {
+	name string
+	fn   EnvFunc
+}
+
+func (h *hostFunc) Gas(index int64, ops interface{}, args []uint64) (uint64, error) {
+	cost, err := h.fn.Gas(index, ops, args)
+	eng, ok := ops.(*Engine)
+	if !ok {
+		return cost, err
+	}
+	if eng.tracer != nil {
+		eng.hostGas = cost
+	}
+	return cost, eng.hostError(h.name, err)
+}
+
+func (h *hostFunc) Call(index int64, ops interface{}, args []uint64) (uint64, error) {
+	eng, ok := ops.(*Engine)
+	if !ok {
+		return h.fn.Call(index, ops, args)
+	}
+	if eng.tracer == nil {
+		ret, err := h.fn.Call(index, ops, args)
+		return ret, eng.hostError(h.name, err)
+	}
+
+	// hostGas is overwritten by nested frames, so take it first.
+	cost := eng.hostGas
+	depth := eng.traceDepth()
+	eng.traceMemory()
+	ret, err := h.fn.Call(index, ops, args)
+	eng.traceMemory()
+	eng.tracer.CaptureHostCall(depth, h.name, args, ret, cost, err)
+	return ret, eng.hostError(h.name, err)
+}